@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
@@ -21,6 +23,11 @@ var (
 	httpLatencySeconds  = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "http_request_duration_seconds", Help: "Request duration seconds", Buckets: prometheus.DefBuckets})
 	httpInFlight        = prometheus.NewGauge(prometheus.GaugeOpts{Name: "http_in_flight_requests", Help: "In-flight requests"})
 	unhealthy 			atomic.Bool
+	// partial failure: % of requests answered 500, and latency that grows
+	// by slowStepMs every second since slowSince (unix nanos, 0 = off)
+	errorRate  atomic.Int64
+	slowSince  atomic.Int64
+	slowStepMs atomic.Int64
 )
 
 func init() {
@@ -50,8 +57,75 @@ mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
 })
 mux.HandleFunc("/recover", func(w http.ResponseWriter, r *http.Request) {
 	unhealthy.Store(false)
+	errorRate.Store(0)
+	slowSince.Store(0)
 	fmt.Fprintln(w, "backend RECOVERED")
 })
+// partial failures: /degrade?rate=30 fails 30% of requests with 500,
+// /slow-degrade?step=50 adds 50ms of latency per second from now on
+mux.HandleFunc("/degrade", func(w http.ResponseWriter, r *http.Request) {
+	rate, err := strconv.Atoi(r.URL.Query().Get("rate"))
+	if err != nil || rate < 0 || rate > 100 {
+		http.Error(w, "rate must be a percentage 0-100", http.StatusBadRequest)
+		return
+	}
+	errorRate.Store(int64(rate))
+	fmt.Fprintf(w, "backend failing %d%% of requests\n", rate)
+})
+mux.HandleFunc("/slow-degrade", func(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("step")
+	if v == "" {
+		v = "50"
+	}
+	step, err := strconv.Atoi(v)
+	if err != nil || step <= 0 {
+		http.Error(w, "step must be a positive number of ms", http.StatusBadRequest)
+		return
+	}
+	slowStepMs.Store(int64(step))
+	slowSince.Store(time.Now().UnixNano())
+	fmt.Fprintf(w, "backend latency growing by %dms/s\n", step)
+})
+// simulate resource pressure for the duration of a request
+mux.HandleFunc("/cpu", func(w http.ResponseWriter, r *http.Request) {
+	ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+	deadline := time.Now().Add(time.Duration(ms) * time.Millisecond)
+	n := 0
+	for time.Now().Before(deadline) {
+		n++
+	}
+	fmt.Fprintf(w, "burned %dms of CPU (%d spins)\n", ms, n)
+})
+mux.HandleFunc("/mem", func(w http.ResponseWriter, r *http.Request) {
+	mb, _ := strconv.Atoi(r.URL.Query().Get("mb"))
+	ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+	buf := make([]byte, max(mb, 0)<<20)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1 // touch every page so it is really resident
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	fmt.Fprintf(w, "held %dMB for %dms\n", len(buf)>>20, ms)
+})
+// echo back what the LB forwarded, for checking header/host forwarding
+mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"service":     name,
+		"method":      r.Method,
+		"proto":       r.Proto,
+		"host":        r.Host,
+		"path":        r.URL.Path,
+		"query":       r.URL.RawQuery,
+		"remote_addr": r.RemoteAddr,
+		"headers":     r.Header,
+		"body":        string(body),
+	})
+})
 
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -67,6 +141,14 @@ mux.HandleFunc("/recover", func(w http.ResponseWriter, r *http.Request) {
 		if jitterMs > 0 {
 			time.Sleep(time.Duration(rand.Intn(jitterMs)) * time.Millisecond)
 		}
+		if since := slowSince.Load(); since != 0 {
+			secs := time.Since(time.Unix(0, since)).Seconds()
+			time.Sleep(time.Duration(secs*float64(slowStepMs.Load())) * time.Millisecond)
+		}
+		if rate := errorRate.Load(); rate > 0 && rand.Int63n(100) < rate {
+			http.Error(w, "degraded", http.StatusInternalServerError)
+			return
+		}
 		uptime := time.Since(start).Truncate(time.Second)
 		host, _ := os.Hostname()
 		fmt.Fprintf(w, "Hello from %s (%s)\n", name, host)
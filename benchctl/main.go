@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	vegeta "github.com/tsenart/vegeta/v12/lib"
@@ -32,6 +37,8 @@ var page = template.Must(template.New("t").Parse(`
   <label>Target URL: <input name="url" value="http://lb:8080/"></label>
   <label>Rate (req/s): <input name="rate" value="100"></label>
   <label>Duration (s): <input name="dur" value="10"></label>
+  <label>LB metrics URL (optional): <input name="metrics" value="" placeholder="http://lb:8080/metrics"></label>
+  <label>Scrape every (s): <input name="every" value="1"></label>
   <button type="submit">Run</button>
 </form>
 <hr>
@@ -45,6 +52,13 @@ var page = template.Must(template.New("t").Parse(`
   <label>Hold 2 (s): <input name="h2" value="15"></label>
   <button type="submit">Run Scenario</button>
 </form>
+<hr>
+<h2>Chaos schedule</h2>
+<p>POST JSON to <code>/chaos</code>: continuous load while backends fail/recover on a schedule; report is per phase.</p>
+<pre>{"url":"http://lb:8080/","rate":150,"duration":"30s",
+ "events":[{"at":"10s","action":"fail","backend":"backend1"},
+           {"at":"20s","action":"recover","backend":"backend1"},
+           {"at":"25s","action":"fail","backend":"backend3"}]}</pre>
 <p>Metrics: <a href="/metrics">/metrics</a></p>
 `))
 
@@ -52,6 +66,7 @@ func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { _ = page.Execute(w, nil) })
 	http.HandleFunc("/run", runHandler)
 	http.HandleFunc("/scenario", scenarioHandler)
+	http.HandleFunc("/chaos", chaosHandler)
 	http.Handle("/metrics", promhttp.Handler())
 
 	log.Println("benchctl listening on :7070")
@@ -59,11 +74,17 @@ func main() {
 }
 
 func runOnce(url string, rate, seconds int) (vegeta.Metrics, error) {
+	return attack(url, rate, seconds, nil)
+}
+
+// attack runs the load and, if onResult is set, hands it every result too.
+func attack(url string, rate, seconds int, onResult func(*vegeta.Result)) (vegeta.Metrics, error) {
 	attacker := vegeta.NewAttacker()
 	targeter := vegeta.NewStaticTargeter(vegeta.Target{Method: "GET", URL: url})
 	var m vegeta.Metrics
 	for res := range attacker.Attack(targeter, vegeta.Rate{Freq: rate, Per: time.Second}, time.Duration(seconds)*time.Second, "benchctl") {
 		m.Add(res)
+		if onResult != nil { onResult(res) }
 	}
 	m.Close()
 	lastRPS.Set(m.Rate)
@@ -81,17 +102,28 @@ func runHandler(w http.ResponseWriter, r *http.Request) {
 	if rate <= 0 { rate = 100 }
 	dur, _ := strconv.Atoi(r.URL.Query().Get("dur"))
 	if dur <= 0 { dur = 10 }
+	metricsURL := r.URL.Query().Get("metrics")
+	every, _ := strconv.Atoi(r.URL.Query().Get("every"))
+	if every <= 0 { every = 1 }
 
-	m, _ := runOnce(url, rate, dur)
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{
+	var m vegeta.Metrics
+	var corr *correlation
+	if metricsURL != "" {
+		m, corr = runCorrelated(url, metricsURL, rate, dur, time.Duration(every)*time.Second)
+	} else {
+		m, _ = runOnce(url, rate, dur)
+	}
+	out := map[string]any{
 		"url": url, "rate": rate, "duration_s": dur,
 		"rps": m.Rate,
 		"latency_p50_s": m.Latencies.P50.Seconds(),
 		"latency_p90_s": m.Latencies.P90.Seconds(),
 		"latency_p99_s": m.Latencies.P99.Seconds(),
 		"errors_count": len(m.Errors),
-	})
+	}
+	if corr != nil { out["lb"] = corr }
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
 }
 
 func scenarioHandler(w http.ResponseWriter, r *http.Request) {
@@ -137,3 +169,232 @@ func runScenario(warm, r1, h1, r2, h2 int) {
 	// 6) Final short run to see 3-way again
 	_, _ = runOnce("http://lb:8080/", r1, 8)
 }
+
+// ---- chaos schedule ----
+
+type chaosEvent struct {
+	At      string `json:"at"`      // offset from start, e.g. "10s"
+	Action  string `json:"action"`  // "fail" or "recover"
+	Backend string `json:"backend"` // e.g. "backend1" or "backend1:8081"
+	at      time.Duration
+}
+
+type chaosRequest struct {
+	URL      string       `json:"url"`
+	Rate     int          `json:"rate"`
+	Duration string       `json:"duration"`
+	Events   []chaosEvent `json:"events"`
+}
+
+type phaseReport struct {
+	From        string  `json:"from"`
+	Event       string  `json:"event,omitempty"`
+	Requests    uint64  `json:"requests"`
+	RPS         float64 `json:"rps"`
+	Success     float64 `json:"success_ratio"`
+	P50         float64 `json:"latency_p50_s"`
+	P90         float64 `json:"latency_p90_s"`
+	P99         float64 `json:"latency_p99_s"`
+	ErrorsCount int     `json:"errors_count"`
+}
+
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" { http.Error(w, "POST a JSON schedule", http.StatusMethodNotAllowed); return }
+	var req chaosRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+	if req.URL == "" { req.URL = "http://lb:8080/" }
+	if req.Rate <= 0 { req.Rate = 100 }
+	dur, err := time.ParseDuration(req.Duration)
+	if err != nil || dur <= 0 { http.Error(w, "invalid duration", http.StatusBadRequest); return }
+	for i := range req.Events {
+		ev := &req.Events[i]
+		if ev.at, err = time.ParseDuration(ev.At); err != nil || ev.at < 0 || ev.at > dur {
+			http.Error(w, fmt.Sprintf("event %d: invalid at %q", i, ev.At), http.StatusBadRequest); return
+		}
+		if ev.Action != "fail" && ev.Action != "recover" {
+			http.Error(w, fmt.Sprintf("event %d: action must be fail or recover", i), http.StatusBadRequest); return
+		}
+		if ev.Backend == "" { http.Error(w, fmt.Sprintf("event %d: missing backend", i), http.StatusBadRequest); return }
+	}
+	sort.SliceStable(req.Events, func(a, b int) bool { return req.Events[a].at < req.Events[b].at })
+
+	phases := runChaos(req.URL, req.Rate, dur, req.Events)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"url": req.URL, "rate": req.Rate, "duration_s": dur.Seconds(), "phases": phases})
+}
+
+// runChaos keeps a constant load on url for dur while firing events at their
+// offsets; results are bucketed into phases delimited by the events.
+func runChaos(url string, rate int, dur time.Duration, events []chaosEvent) []phaseReport {
+	scenarioOn.Set(1)
+	defer scenarioOn.Set(0)
+
+	start := time.Now()
+	for _, ev := range events {
+		ev := ev
+		time.AfterFunc(ev.at, func() {
+			host := ev.Backend
+			if !strings.Contains(host, ":") { host += ":8081" }
+			resp, err := http.Get("http://" + host + "/" + ev.Action)
+			if err != nil { log.Printf("chaos: %s %s: %v", ev.Action, ev.Backend, err); return }
+			resp.Body.Close()
+			log.Printf("chaos: %s %s at %s", ev.Action, ev.Backend, ev.at)
+		})
+	}
+
+	metrics := make([]vegeta.Metrics, len(events)+1)
+	attacker := vegeta.NewAttacker()
+	targeter := vegeta.NewStaticTargeter(vegeta.Target{Method: "GET", URL: url})
+	var all vegeta.Metrics
+	for res := range attacker.Attack(targeter, vegeta.Rate{Freq: rate, Per: time.Second}, dur, "benchctl-chaos") {
+		off, phase := res.Timestamp.Sub(start), 0
+		for phase < len(events) && events[phase].at <= off { phase++ }
+		metrics[phase].Add(res)
+		all.Add(res)
+	}
+	all.Close()
+	lastRPS.Set(all.Rate)
+	lastP50.Set(all.Latencies.P50.Seconds())
+	lastP90.Set(all.Latencies.P90.Seconds())
+	lastP99.Set(all.Latencies.P99.Seconds())
+	lastErrors.Set(float64(len(all.Errors)))
+
+	out := make([]phaseReport, 0, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		m.Close()
+		p := phaseReport{
+			From: "0s", Requests: m.Requests, RPS: m.Rate, Success: m.Success,
+			P50: m.Latencies.P50.Seconds(), P90: m.Latencies.P90.Seconds(), P99: m.Latencies.P99.Seconds(),
+			ErrorsCount: len(m.Errors),
+		}
+		if i > 0 {
+			ev := events[i-1]
+			p.From, p.Event = ev.at.String(), ev.Action+" "+ev.Backend
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// ---- LB metrics correlation ----
+
+// lbCounters holds per-backend LB counters from one /metrics scrape.
+type lbCounters struct {
+	Attempts map[string]float64 `json:"attempts"`
+	Failures map[string]float64 `json:"failures"`
+}
+
+// scrapeClient bounds each scrape so a hung LB cannot stall a bench run.
+var scrapeClient = &http.Client{Timeout: 5 * time.Second}
+
+// scrapeLB fetches the LB's Prometheus text output and sums
+// lb_backend_attempts_total / lb_backend_failures_total per backend.
+func scrapeLB(metricsURL string) (lbCounters, error) {
+	c := lbCounters{Attempts: map[string]float64{}, Failures: map[string]float64{}}
+	resp, err := scrapeClient.Get(metricsURL)
+	if err != nil { return c, err }
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		var dst map[string]float64
+		switch {
+		case strings.HasPrefix(line, "lb_backend_attempts_total{"): dst = c.Attempts
+		case strings.HasPrefix(line, "lb_backend_failures_total{"): dst = c.Failures
+		default: continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil { continue }
+		dst[labelValue(line[:i], "backend")] += v
+	}
+	return c, sc.Err()
+}
+
+func labelValue(series, name string) string {
+	_, rest, ok := strings.Cut(series, name+`="`)
+	if !ok { return "" }
+	v, _, _ := strings.Cut(rest, `"`)
+	return v
+}
+
+func (c lbCounters) sub(prev lbCounters) lbCounters {
+	d := lbCounters{Attempts: map[string]float64{}, Failures: map[string]float64{}}
+	for k, v := range c.Attempts { d.Attempts[k] = v - prev.Attempts[k] }
+	for k, v := range c.Failures { d.Failures[k] = v - prev.Failures[k] }
+	return d
+}
+
+type timelinePoint struct {
+	At          string  `json:"at"`
+	Requests    uint64  `json:"requests"`
+	P50         float64 `json:"latency_p50_s"`
+	P99         float64 `json:"latency_p99_s"`
+	ErrorsCount int     `json:"errors_count"`
+	lbCounters
+}
+
+type correlation struct {
+	MetricsURL string          `json:"metrics_url"`
+	Total      lbCounters      `json:"total"`
+	Timeline   []timelinePoint `json:"timeline"`
+	ScrapeErr  string          `json:"scrape_error,omitempty"`
+}
+
+// runCorrelated runs the load while scraping the LB every interval; each
+// timeline point pairs client-side latency for that interval with the LB's
+// per-backend attempt/failure deltas over the same window.
+func runCorrelated(url, metricsURL string, rate, seconds int, every time.Duration) (vegeta.Metrics, *correlation) {
+	corr := &correlation{MetricsURL: metricsURL}
+	first, err := scrapeLB(metricsURL)
+	if err != nil { corr.ScrapeErr = err.Error() }
+
+	var mu sync.Mutex
+	var window vegeta.Metrics
+	prev, start := first, time.Now()
+	flush := func() {
+		cur, err := scrapeLB(metricsURL)
+		mu.Lock()
+		w := window
+		window = vegeta.Metrics{}
+		mu.Unlock()
+		w.Close()
+		p := timelinePoint{
+			At: time.Since(start).Truncate(time.Millisecond).String(), Requests: w.Requests,
+			P50: w.Latencies.P50.Seconds(), P99: w.Latencies.P99.Seconds(), ErrorsCount: len(w.Errors),
+		}
+		if err != nil {
+			corr.ScrapeErr = err.Error()
+		} else {
+			p.lbCounters = cur.sub(prev)
+			prev = cur
+		}
+		corr.Timeline = append(corr.Timeline, p)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C: flush()
+			case <-done: return
+			}
+		}
+	}()
+	m, _ := attack(url, rate, seconds, func(res *vegeta.Result) {
+		mu.Lock()
+		window.Add(res)
+		mu.Unlock()
+	})
+	close(done)
+	<-stopped
+	flush()
+	corr.Total = prev.sub(first)
+	return m, corr
+}
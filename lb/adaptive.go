@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+/* ================= Least connections and adaptive selection ================= */
+
+func init() {
+	RegisterSelector(StrategyLeastConn, SelectorFunc(func(_ *LoadBalancer, p *Pool, _ *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		return p.nextLeastConn(tried)
+	}))
+	RegisterSelector(StrategyAdaptive, SelectorFunc(func(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		sel, ok := lookupSelector(lb.adaptiveStrategy())
+		if !ok {
+			return nil, -1, fmt.Errorf("unknown strategy %q", lb.adaptiveStrategy())
+		}
+		return sel.Pick(lb, p, r, tried)
+	}))
+}
+
+// nextLeastConn picks the alive untried backend with the fewest in-flight
+// requests. The scan starts after the last pick so ties rotate instead of
+// piling onto the first backend. Caller holds p.mu.
+func (p *Pool) nextLeastConn(tried map[*Backend]bool) (*Backend, int, error) {
+	n, best, alive := len(p.Backends), -1, false
+	var bestActive int64
+	for k := 1; k <= n; k++ {
+		i := (p.current + k) % n
+		b := p.Backends[i]
+		if !b.IsAlive() {
+			continue
+		}
+		alive = true
+		if tried[b] {
+			continue
+		}
+		if active := b.active.Load(); best < 0 || active < bestActive {
+			best, bestActive = i, active
+		}
+	}
+	if best >= 0 {
+		p.current = best
+		return p.Backends[best], best, nil
+	}
+	if alive {
+		return nil, -1, errAllTried
+	}
+	return nil, -1, errNoAlive
+}
+
+// adaptiveStrategy is the strategy LB_STRATEGY=adaptive delegates to: it
+// moves to AdaptiveHigh once AdaptiveHighWater requests are in flight and
+// back to AdaptiveLow when they fall to AdaptiveLowWater, so load hovering
+// around one threshold does not flap.
+func (lb *LoadBalancer) adaptiveStrategy() string {
+	n := lb.inFlight.Load()
+	switch high := lb.adaptiveHigh.Load(); {
+	case !high && n >= lb.AdaptiveHighWater:
+		if lb.adaptiveHigh.CompareAndSwap(false, true) {
+			log.Printf("[LB] adaptive strategy %s -> %s (%d in flight)", lb.AdaptiveLow, lb.AdaptiveHigh, n)
+		}
+	case high && n <= lb.AdaptiveLowWater:
+		if lb.adaptiveHigh.CompareAndSwap(true, false) {
+			log.Printf("[LB] adaptive strategy %s -> %s (%d in flight)", lb.AdaptiveHigh, lb.AdaptiveLow, n)
+		}
+	}
+	if lb.adaptiveHigh.Load() {
+		return lb.AdaptiveHigh
+	}
+	return lb.AdaptiveLow
+}
+
+// checkAdaptive rejects adaptive settings that would loop or never switch.
+func checkAdaptive(low, high string, lowWater, highWater int64) error {
+	for _, s := range []string{low, high} {
+		if s == StrategyAdaptive {
+			return fmt.Errorf("adaptive cannot delegate to itself")
+		}
+		if _, ok := lookupSelector(s); !ok {
+			return fmt.Errorf("unknown strategy %q", s)
+		}
+	}
+	if highWater <= 0 || lowWater < 0 || lowWater >= highWater {
+		return fmt.Errorf("want 0 <= ADAPTIVE_LOW_WATER < ADAPTIVE_HIGH_WATER, got %d and %d", lowWater, highWater)
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Admin ================= */
+
+// adminMux holds the admin API and pprof (reachable only when it has its
+// own listener, see main). Every endpoint needs ADMIN_TOKEN: even the
+// read-only ones expose backend topology and settings such as the
+// dead-letter URL.
+func (lb *LoadBalancer) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	guard := func(h http.HandlerFunc) http.Handler { return adminToken(lb.AdminToken, h) }
+	mux.Handle("/admin/config", guard(lb.adminConfig))
+	mux.Handle("/admin/metrics-summary", guard(lb.adminSummary))
+	mux.Handle("/admin/fairness", guard(lb.adminFairness))
+	mux.Handle("/admin/active-pool", guard(lb.adminActivePool))
+	mux.Handle("/admin/backends", guard(lb.adminBackends))
+	mux.Handle("/admin/backends/check", guard(lb.adminCheck))
+	mux.Handle("/admin/debug/stats", guard(lb.adminDebugStats))
+	mux.Handle("/debug/pprof/", guard(pprof.Index))
+	mux.Handle("/debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", guard(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", guard(pprof.Symbol))
+	mux.Handle("/debug/pprof/trace", guard(pprof.Trace))
+	return mux
+}
+
+type backendView struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+	Zone   string `json:"zone,omitempty"`
+	Tier   string `json:"tier,omitempty"`
+	Alive  bool   `json:"alive"`
+	Active int64  `json:"active"`
+
+	KeepAlive bool `json:"keepalive"`
+	// EffectiveWeight is Weight scaled by the health score, in 1/100ths.
+	EffectiveWeight int `json:"effective_weight"`
+	// ReqTimeout is the per-attempt timeout in effect for this backend.
+	ReqTimeout string `json:"req_timeout"`
+	// Headers names the static request headers sent to this backend;
+	// values are left out as they often carry credentials.
+	Headers []string `json:"headers,omitempty"`
+
+	LastStateChange time.Time `json:"last_state_change"`
+	CoolingOff      bool      `json:"cooling_off"`
+}
+
+func (lb *LoadBalancer) allPools() []*Pool {
+	lb.mu.RLock()
+	ps := append([]*Pool(nil), lb.pools...)
+	lb.mu.RUnlock()
+	if lb.UploadPool != nil {
+		ps = append(ps, lb.UploadPool)
+	}
+	if lb.MirrorPool != nil {
+		ps = append(ps, lb.MirrorPool)
+	}
+	return ps
+}
+
+// headerNames lists h's keys in sorted order, or nil when h is empty.
+func headerNames(h http.Header) []string {
+	var names []string
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (lb *LoadBalancer) backendViews() []backendView {
+	var out []backendView
+	for _, p := range lb.allPools() {
+		for _, b := range p.members() {
+			out = append(out, backendView{
+				Name: b.Name, URL: b.URL.String(), Pool: p.Name,
+				Weight: b.Weight, Zone: b.Zone, Tier: b.Tier, Alive: b.IsAlive(), Active: b.active.Load(),
+				KeepAlive: !b.transport.DisableKeepAlives, EffectiveWeight: b.effectiveWeight(),
+				ReqTimeout: lb.reqTimeoutFor(b).String(), LastStateChange: b.lastStateChange(),
+				CoolingOff: b.coolingOff(time.Now()), Headers: headerNames(b.headers),
+			})
+		}
+	}
+	return out
+}
+
+// adminToken guards an admin endpoint with a bearer token. With no
+// ADMIN_TOKEN configured every request is refused outright.
+func adminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin API disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminActivePool reports (GET) or switches (POST {"pool":"green"}) the
+// pool that normal traffic is drawn from.
+func (lb *LoadBalancer) adminActivePool(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Pool string `json:"pool"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Pool == "" {
+			http.Error(w, `expected {"pool":"<name>"}`, http.StatusBadRequest)
+			return
+		}
+		if err := lb.SetActivePool(body.Pool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"active_pool": lb.activePool().Name})
+}
+
+// adminConfig reports the effective, parsed configuration.
+func (lb *LoadBalancer) adminConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"strategy":           lb.Strategy,
+		"adaptive":           lb.AdaptiveLow + "/" + lb.AdaptiveHigh,
+		"adaptive_water":     [2]int64{lb.AdaptiveLowWater, lb.AdaptiveHighWater},
+		"hash_fallback":      lb.HashFallbackDepth,
+		"active_pool":        lb.activePool().Name,
+		"backends":           lb.backendViews(),
+		"health_check_type":  lb.HealthCheckType,
+		"health_path":        lb.HealthPath,
+		"deep_health_path":   lb.DeepHealthPath,
+		"health_log_every":   lb.HealthLogInterval.String(),
+		"health_interval":    lb.HealthInterval.String(),
+		"health_timeout":     lb.HealthTimeout.String(),
+		"health_weighting":   lb.HealthWeighting,
+		"load_header":        lb.LoadHeader,
+		"max_consec_fail":    lb.MaxConsecFail,
+		"health_rise":        lb.HealthRiseThreshold,
+		"breaker_cooldown":   lb.BreakerCooldown.String(),
+		"tls_trips_breaker":  lb.TLSErrorTripsBreaker,
+		"req_timeout":        lb.ReqTimeout.String(),
+		"total_timeout":      lb.TotalTimeout.String(),
+		"retry_after":        lb.RetryAfter.String(),
+		"retry_after_max":    lb.BackendRetryAfterMax.String(),
+		"error_format":       lb.ErrorFormat,
+		"error_pages":        len(lb.ErrorPages),
+		"error_headers":      lb.ErrorHeaders,
+		"max_retries":        lb.MaxRetries,
+		"max_retries_cap":    lb.MaxRetriesCap,
+		"retry_all_backends": lb.RetryAllBackends,
+		"retry_healthiest":   lb.RetryPreferHealthy,
+		"weight_decay":       lb.WeightDecay,
+		"pool_fail_fast":     lb.PoolFailFast,
+		"dial_mode":          lb.DialMode,
+		"max_conn_age":       lb.MaxConnAge.String(),
+		"serve_stale":        lb.stale != nil,
+		"upload_threshold":   lb.UploadThreshold,
+		"max_body_bytes":     lb.MaxBodyBytes,
+		"retry_body_bytes":   lb.RetryBodyBytes,
+		"expect_continue":    lb.ExpectContinue,
+		"response_mode":      lb.ResponseMode,
+		"client_ip_sources":  lb.IPSources,
+		"trusted_proxy_nets": len(lb.TrustedProxies),
+		"deny_paths":         rawRules(lb.DenyPaths),
+		"allowed_methods":    lb.AllowedMethods,
+		"cors":               lb.CORS != nil,
+		"conn_high_water":    lb.ConnHighWater,
+		"session_affinity":   lb.sessions != nil,
+		"jwt_tiers":          lb.tiers != nil,
+		"tenant_limits":      lb.tenants != nil,
+		"tier_limits":        lb.tierLimits != nil,
+		"mirror_percent":     lb.MirrorPercent,
+		"attempt_trace":      lb.AttemptTrace,
+		"trace_match":        len(lb.TraceMatch),
+		"trace_redact":       lb.TraceRedact,
+		"shutdown_header":    lb.ShutdownHeader,
+		"http10_mode":        lb.HTTP10Mode,
+		"min_healthy_frac":   lb.MinHealthyFraction,
+		"degraded_shed":      rawRules(lb.DegradedShedPaths),
+		"slo_threshold":      lb.SLOThreshold.String(),
+		"slow_threshold":     lb.SlowThreshold.String(),
+		"expose_backend":     lb.ExposeBackend,
+		"mask_upstream_errs": lb.MaskUpstreamErrors,
+		"status_rules":       len(lb.StatusRules),
+		"connect_allow":      len(lb.ConnectAllow),
+		"fairness_window":    lb.FairnessWindow.String(),
+		"preserve_host":      lb.PreserveHost,
+		"forward_trailers":   lb.ForwardTrailers,
+		"forwarded_port":     lb.ForwardedPort,
+		"forwarded_server":   lb.ForwardedServer,
+		"forwarded_headers":  lb.ForwardedPolicy,
+		"rewrite_location":   lb.RewriteLocation,
+		"dead_letter_url":    lb.DeadLetterURL,
+		"warmup_conns":       lb.WarmupConns,
+		"max_resp_headers":   lb.MaxResponseHeaderBytes,
+		"pool_keepalive":     lb.KeepaliveInterval.String(),
+		"group_status_codes": lb.GroupStatusCodes,
+		"response_size":      lb.ResponseSizeMetrics,
+	})
+}
+
+// adminBackends lists backends (GET) or removes one after draining it
+// (DELETE ?url=<backend url>&drain_timeout=30s). The drain can outlast
+// the server's write timeout, so DELETE answers 202 at once and the
+// outcome is logged; GET shows the backend gone once it is removed.
+func (lb *LoadBalancer) adminBackends(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(lb.backendViews())
+	case http.MethodDelete:
+		target, err := BackendConfig{URL: r.URL.Query().Get("url")}.parseURL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout := 30 * time.Second
+		if v := r.URL.Query().Get("drain_timeout"); v != "" {
+			if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+				http.Error(w, "invalid drain_timeout", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, b := range lb.backends() {
+			if b.URL.String() == target.String() {
+				if !b.draining.CompareAndSwap(false, true) {
+					http.Error(w, b.Name+" is already draining", http.StatusConflict)
+					return
+				}
+				go lb.RemoveBackend(b, timeout)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"removing": b.Name, "drain_timeout": timeout.String(), "in_flight": b.active.Load(),
+				})
+				return
+			}
+		}
+		http.Error(w, "unknown backend "+target.String(), http.StatusNotFound)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type checkResult struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Alive bool   `json:"alive"`
+	Error string `json:"error,omitempty"`
+}
+
+// adminCheck runs a health check right away, for ?url= or every backend,
+// so a fixed backend rejoins without waiting for HealthInterval.
+func (lb *LoadBalancer) adminCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	targets := lb.backends()
+	if v := r.URL.Query().Get("url"); v != "" {
+		target, err := BackendConfig{URL: v}.parseURL()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets = nil
+		for _, b := range lb.backends() {
+			if b.URL.String() == target.String() {
+				targets = append(targets, b)
+			}
+		}
+		if len(targets) == 0 {
+			http.Error(w, "unknown backend "+target.String(), http.StatusNotFound)
+			return
+		}
+	}
+	results := make([]checkResult, len(targets))
+	var wg sync.WaitGroup
+	for i, b := range targets {
+		wg.Add(1)
+		go func(i int, b *Backend) {
+			defer wg.Done()
+			res := checkResult{Name: b.Name, URL: b.URL.String()}
+			if err := lb.check(b); err != nil {
+				res.Error = err.Error()
+			}
+			res.Alive = b.IsAlive()
+			results[i] = res
+		}(i, b)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+type connView struct {
+	Name      string `json:"name"`
+	Active    int64  `json:"active"`
+	Open      int64  `json:"open_conns"`
+	Dialed    int64  `json:"dialed"`
+	Reused    int64  `json:"reused"`
+	MaxIdle   int    `json:"max_idle_per_host"`
+	KeepAlive bool   `json:"keepalive"`
+}
+
+// adminDebugStats reports internals useful in an incident: goroutines,
+// in-flight requests and per-backend connection reuse. A low reused/dialed
+// ratio points at connections not being kept alive; open far above active
+// at idle connections piling up.
+func (lb *LoadBalancer) adminDebugStats(w http.ResponseWriter, r *http.Request) {
+	var inFlight int64
+	var views []connView
+	for _, b := range lb.backends() {
+		active := b.active.Load()
+		inFlight += active
+		maxIdle := b.transport.MaxIdleConnsPerHost
+		if maxIdle == 0 {
+			maxIdle = http.DefaultMaxIdleConnsPerHost
+		}
+		views = append(views, connView{
+			Name: b.Name, Active: active,
+			Open: b.conns.open.Load(), Dialed: b.conns.dialed.Load(), Reused: b.conns.reused.Load(),
+			MaxIdle: maxIdle, KeepAlive: !b.transport.DisableKeepAlives,
+		})
+	}
+	sessions := 0
+	if lb.sessions != nil {
+		sessions = lb.sessions.count()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"goroutines": runtime.NumGoroutine(),
+		"in_flight":  inFlight,
+		"sessions":   sessions,
+		"backends":   views,
+	})
+}
+
+/* ================= Status page ================= */
+
+var summaryPage = template.Must(template.New("summary").Parse(`
+<!doctype html><meta charset="utf-8"><title>lb status</title>
+<meta http-equiv="refresh" content="3">
+<style>body{font-family:sans-serif;max-width:760px;margin:40px auto}td,th{padding:4px 10px;text-align:left}.down{color:#b00}</style>
+<h1>lb status</h1>
+<p>Strategy: <b>{{.Strategy}}</b> &middot; Alive: <b>{{.Alive}}/{{len .Rows}}</b></p>
+<table>
+<tr><th>Backend</th><th>Pool</th><th>Weight</th><th>State</th><th>Active</th><th>Attempts ({{.Span}})</th><th>Failures ({{.Span}})</th></tr>
+{{range .Rows}}<tr{{if not .Alive}} class="down"{{end}}><td>{{.Name}}</td><td>{{.Pool}}</td><td>{{.Weight}}</td>
+<td>{{if .Alive}}UP{{else}}DOWN{{end}}</td><td>{{.Active}}</td><td>{{.Attempts}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+<p>Metrics: <a href="/metrics">/metrics</a> &middot; Config: <a href="/admin/config">/admin/config</a></p>
+`))
+
+type summaryRow struct {
+	backendView
+	Active   float64
+	Attempts float64
+	Failures float64
+}
+
+// summaryWindow is how far back the status page's Attempts and Failures
+// columns look.
+const summaryWindow = time.Minute
+
+type summarySample struct {
+	at   time.Time
+	sums map[string]map[string]float64
+}
+
+// recentSums turns the cumulative counter sums into increases since the
+// oldest render within summaryWindow, and returns the span they cover.
+// The first render after a quiet spell has no baseline and shows zeros.
+func (lb *LoadBalancer) recentSums(now time.Time, sums map[string]map[string]float64) (map[string]map[string]float64, time.Duration) {
+	lb.summaryMu.Lock()
+	defer lb.summaryMu.Unlock()
+	lb.summarySamples = append(lb.summarySamples, summarySample{at: now, sums: sums})
+	// Keep the newest sample that is at least summaryWindow old as the
+	// baseline and drop everything before it.
+	for len(lb.summarySamples) > 1 && now.Sub(lb.summarySamples[1].at) >= summaryWindow {
+		lb.summarySamples = lb.summarySamples[1:]
+	}
+	base := lb.summarySamples[0]
+	out := map[string]map[string]float64{}
+	for family, byBackend := range sums {
+		out[family] = map[string]float64{}
+		for name, v := range byBackend {
+			out[family][name] = v - base.sums[family][name]
+		}
+	}
+	return out, now.Sub(base.at)
+}
+
+// metricSums gathers the registered metrics and sums the named family per
+// backend label, so the page shows exactly what /metrics exports.
+func metricSums(families map[string]bool) map[string]map[string]float64 {
+	out := map[string]map[string]float64{}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return out
+	}
+	for _, mf := range mfs {
+		if !families[mf.GetName()] {
+			continue
+		}
+		sums := map[string]float64{}
+		for _, m := range mf.GetMetric() {
+			var backend string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "backend" {
+					backend = l.GetValue()
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				sums[backend] += m.Counter.GetValue()
+			case m.Gauge != nil:
+				sums[backend] += m.Gauge.GetValue()
+			}
+		}
+		out[mf.GetName()] = sums
+	}
+	return out
+}
+
+// adminSummary renders an auto-refreshing, human-readable status page.
+func (lb *LoadBalancer) adminSummary(w http.ResponseWriter, r *http.Request) {
+	sums := metricSums(map[string]bool{
+		"lb_backend_active_connections": true,
+		"lb_backend_attempts_total":     true,
+		"lb_backend_failures_total":     true,
+	})
+	recent, span := lb.recentSums(time.Now(), map[string]map[string]float64{
+		"attempts": sums["lb_backend_attempts_total"],
+		"failures": sums["lb_backend_failures_total"],
+	})
+	var rows []summaryRow
+	alive := 0
+	for _, v := range lb.backendViews() {
+		if v.Alive {
+			alive++
+		}
+		rows = append(rows, summaryRow{
+			backendView: v,
+			Active:      sums["lb_backend_active_connections"][v.Name],
+			Attempts:    recent["attempts"][v.Name],
+			Failures:    recent["failures"][v.Name],
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = summaryPage.Execute(w, map[string]any{"Strategy": lb.Strategy, "Alive": alive, "Rows": rows, "Span": "last " + span.Round(time.Second).String()})
+}
+
+/* ================= Backend pinning ================= */
+
+// pinnedPool handles the operator-only X-LB-Backend header, which pins a
+// request to one named backend (host:port or just host). It returns a
+// single-backend pool for the pin, nil when no pin was requested, and
+// ok=false after writing an error response. Both headers are stripped.
+func (lb *LoadBalancer) pinnedPool(w http.ResponseWriter, r *http.Request) (*Pool, bool) {
+	name, token := r.Header.Get("X-LB-Backend"), r.Header.Get("X-LB-Admin-Token")
+	r.Header.Del("X-LB-Backend")
+	r.Header.Del("X-LB-Admin-Token")
+	if name == "" {
+		return nil, true
+	}
+	if lb.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(lb.AdminToken)) != 1 {
+		lb.writeError(w, r, http.StatusForbidden, reasonPinned, "X-LB-Backend requires a valid X-LB-Admin-Token")
+		return nil, false
+	}
+	for _, b := range lb.backends() {
+		if b.Name != name && b.URL.Hostname() != name {
+			continue
+		}
+		if !b.IsAlive() {
+			lb.writeError(w, r, http.StatusServiceUnavailable, reasonPinned, "pinned backend "+b.Name+" is down")
+			return nil, false
+		}
+		return &Pool{Name: "pinned", Backends: []*Backend{b}}, true
+	}
+	lb.writeError(w, r, http.StatusBadRequest, reasonPinned, "unknown backend "+name)
+	return nil, false
+}
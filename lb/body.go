@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/* ================= Request bodies (Expect + retry replay) ================= */
+
+const (
+	// ExpectForward passes "Expect: 100-continue" through so the backend
+	// decides whether the client may send the body. Such requests are
+	// streamed and never retried, since the body is not held by the LB.
+	ExpectForward = "forward"
+	// ExpectLocal answers 100 Continue at the LB, strips Expect from the
+	// proxied request and treats the body like any other.
+	ExpectLocal = "local"
+)
+
+func parseExpectMode(v string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(v)); m {
+	case ExpectForward, ExpectLocal:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want %s or %s)", v, ExpectForward, ExpectLocal)
+}
+
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// replayBody decides how a request body is sent when the request may be
+// retried. It returns the buffered body when every attempt can replay it,
+// or ok=false when the body must be streamed once and retries disabled:
+// forwarded 100-continue, unknown length, or larger than RetryBodyBytes.
+// The read itself triggers the server's 100 Continue to the client.
+func (lb *LoadBalancer) replayBody(r *http.Request) (body []byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if expectsContinue(r) && lb.ExpectContinue == ExpectForward {
+		return nil, false, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > lb.RetryBodyBytes {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(r.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// writeBodyError reports a failed body read: 413 for MaxBodyBytes, else 400.
+func (lb *LoadBalancer) writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		lb.writeError(w, r, http.StatusRequestEntityTooLarge, reasonBodyTooLarge, "request body too large")
+		return
+	}
+	lb.writeError(w, r, http.StatusBadRequest, reasonBadBody, "error reading request body")
+}
+
+// setBody gives an attempt its own reader over a buffered body.
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	r.ContentLength = int64(len(body))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		sources string
+		peer    string
+		xff     []string
+		realIP  string
+		want    string
+	}{
+		{name: "untrusted peer ignores XFF", sources: "x-forwarded-for,remote", peer: "203.0.113.9", xff: []string{"198.51.100.1"}, want: "203.0.113.9"},
+		{name: "trusted peer uses XFF", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "skips trusted hops right to left", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"192.0.2.7, 198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "all hops trusted uses leftmost", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "separate header lines are one list", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"192.0.2.66", "198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "proxy's own line is not skipped", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"192.0.2.66", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "unparseable hop falls back", sources: "x-forwarded-for,remote", peer: "10.0.0.1", xff: []string{"198.51.100.1, junk"}, want: "10.0.0.1"},
+		{name: "unparseable hop falls to next source", sources: "x-forwarded-for,x-real-ip,remote", peer: "10.0.0.1", xff: []string{"junk"}, realIP: "198.51.100.5", want: "198.51.100.5"},
+		{name: "sources are tried in order", sources: "x-real-ip,x-forwarded-for", peer: "10.0.0.1", xff: []string{"198.51.100.1"}, realIP: "198.51.100.5", want: "198.51.100.5"},
+		{name: "remote first ignores headers", sources: "remote,x-forwarded-for", peer: "10.0.0.1", xff: []string{"198.51.100.1"}, want: "10.0.0.1"},
+		{name: "untrusted peer ignores X-Real-IP", sources: "x-real-ip,remote", peer: "203.0.113.9", realIP: "198.51.100.5", want: "203.0.113.9"},
+	} {
+		sources, err := parseIPSources(tc.sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb := &LoadBalancer{IPSources: sources, TrustedProxies: trusted}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer + ":4000"
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := lb.clientIP(r); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ================= Backend config ================= */
+
+// BackendConfig describes one backend as given in BACKENDS or BACKENDS_JSON.
+type BackendConfig struct {
+	URL    string `json:"url"`
+	Weight *int   `json:"weight,omitempty"` // nil means 1
+	Zone   string `json:"zone,omitempty"`
+	Tier   string `json:"tier,omitempty"`
+
+	// DisableKeepAlive opens a fresh connection per request, for backends
+	// with broken connection reuse.
+	DisableKeepAlive bool `json:"disable_keepalive,omitempty"`
+
+	// PreserveHost overrides the global PRESERVE_HOST for this backend.
+	PreserveHost *bool `json:"preserve_host,omitempty"`
+
+	// ReqTimeout (e.g. "30s") overrides the global REQ_TIMEOUT for
+	// requests sent to this backend; empty uses the global value.
+	ReqTimeout string `json:"req_timeout,omitempty"`
+
+	// Headers are set on every request sent to this backend, after the
+	// X-Forwarded-* headers, replacing any the client sent.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (c BackendConfig) weight() int {
+	if c.Weight == nil {
+		return 1
+	}
+	return *c.Weight
+}
+
+// header returns Headers in canonical form, or nil when there are none.
+func (c BackendConfig) header() http.Header {
+	if len(c.Headers) == 0 {
+		return nil
+	}
+	h := http.Header{}
+	for k, v := range c.Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// reqTimeout returns the per-backend timeout, or 0 when unset. The value
+// has already been validated by parseBackendsJSON.
+func (c BackendConfig) reqTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.ReqTimeout)
+	return d
+}
+
+// parseURL normalizes the backend URL: a missing scheme defaults to http and
+// trailing slashes are dropped. unix:///path/to.sock names a Unix socket.
+func (c BackendConfig) parseURL() (*url.URL, error) {
+	raw := strings.TrimSpace(c.URL)
+	if strings.HasPrefix(raw, "unix://") {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return nil, fmt.Errorf("invalid backend url %q: want unix:///absolute/path.sock", c.URL)
+		}
+		return u, nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend url %q: %v", c.URL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid backend url %q: missing host", c.URL)
+	}
+	return u, nil
+}
+
+// validateBackends checks every URL and that weights are non-negative and
+// not all zero.
+func validateBackends(cfgs []BackendConfig) error {
+	total := 0
+	for _, cfg := range cfgs {
+		if _, err := cfg.parseURL(); err != nil {
+			return err
+		}
+		if cfg.weight() < 0 {
+			return fmt.Errorf("invalid weight for %q: must be a non-negative integer", cfg.URL)
+		}
+		total += cfg.weight()
+	}
+	if len(cfgs) > 0 && total == 0 {
+		return fmt.Errorf("invalid backends: all weights are zero")
+	}
+	return nil
+}
+
+// parseBackendsCSV parses the BACKENDS list: comma-separated entries of the
+// form "url" or "url|weight".
+func parseBackendsCSV(v string) ([]BackendConfig, error) {
+	var cfgs []BackendConfig
+	for _, spec := range splitList(v) {
+		cfg := BackendConfig{URL: spec}
+		if i := strings.LastIndex(spec, "|"); i >= 0 {
+			w, err := strconv.Atoi(strings.TrimSpace(spec[i+1:]))
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight in %q: must be a non-negative integer", spec)
+			}
+			cfg.URL, cfg.Weight = strings.TrimSpace(spec[:i]), &w
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// parseBackendsJSON parses BACKENDS_JSON, an array of BackendConfig objects.
+func parseBackendsJSON(v string) ([]BackendConfig, error) {
+	var cfgs []BackendConfig
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfgs); err != nil {
+		return nil, fmt.Errorf("invalid BACKENDS_JSON: %v", err)
+	}
+	for i, c := range cfgs {
+		if c.URL == "" {
+			return nil, fmt.Errorf("invalid BACKENDS_JSON: entry %d has no url", i)
+		}
+		if c.weight() < 0 {
+			return nil, fmt.Errorf("invalid BACKENDS_JSON: %q weight must be non-negative", c.URL)
+		}
+		if c.ReqTimeout != "" {
+			if d, err := time.ParseDuration(c.ReqTimeout); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid BACKENDS_JSON: %q req_timeout %q must be a positive duration", c.URL, c.ReqTimeout)
+			}
+		}
+		for k, v := range c.Headers {
+			if k == "" || strings.ContainsAny(k, " \t\r\n:") || strings.ContainsAny(v, "\r\n") {
+				return nil, fmt.Errorf("invalid BACKENDS_JSON: %q header %q is not a valid header", c.URL, k)
+			}
+			if http.CanonicalHeaderKey(k) == "Host" {
+				return nil, fmt.Errorf("invalid BACKENDS_JSON: %q cannot set Host in headers (use preserve_host)", c.URL)
+			}
+		}
+	}
+	return cfgs, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Forward proxy (CONNECT) ================= */
+
+var lbConnectTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_connect_tunnels_total", Help: "CONNECT requests by result (ok, denied, error)"},
+	[]string{"result"},
+)
+
+func init() { prometheus.MustRegister(lbConnectTotal) }
+
+// connectRule is one CONNECT_ALLOW destination. host may be "*.suffix"
+// (any name under suffix, not suffix itself) and port "*".
+type connectRule struct{ host, port string }
+
+// parseConnectAllow parses CONNECT_ALLOW, e.g.
+// "git.internal:22,*.svc.internal:443". A wildcard must name a domain:
+// "*" alone or "*internal" would make the LB an open relay.
+func parseConnectAllow(v string) ([]connectRule, error) {
+	var rules []connectRule
+	for _, item := range splitList(v) {
+		host, port, err := net.SplitHostPort(item)
+		if err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("invalid destination %q: want host:port", item)
+		}
+		if i := strings.Index(host, "*"); i >= 0 {
+			suffix, ok := strings.CutPrefix(host, "*.")
+			if !ok || suffix == "" || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("invalid destination %q: wildcards must be *.domain", item)
+			}
+		}
+		rules = append(rules, connectRule{strings.ToLower(host), port})
+	}
+	return rules, nil
+}
+
+func (lb *LoadBalancer) connectAllowed(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, rule := range lb.ConnectAllow {
+		if rule.port != "*" && rule.port != port {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(rule.host, "*"); ok && len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+			return true
+		}
+		if rule.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConnect tunnels a CONNECT request to its destination when it is
+// allowlisted. Bytes are copied both ways until either side closes.
+func (lb *LoadBalancer) serveConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if !lb.connectAllowed(target) {
+		lbConnectTotal.WithLabelValues("denied").Inc()
+		lb.writeError(w, r, http.StatusForbidden, reasonConnect, "CONNECT to "+target+" not allowed")
+		return
+	}
+	dst, err := (&net.Dialer{Timeout: lb.DialTimeout}).DialContext(r.Context(), "tcp", target)
+	if err != nil {
+		lbConnectTotal.WithLabelValues("error").Inc()
+		log.Printf("[connect] %s: %v", target, err)
+		lb.writeError(w, r, http.StatusBadGateway, reasonConnect, "cannot reach "+target)
+		return
+	}
+	src, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		dst.Close()
+		lbConnectTotal.WithLabelValues("error").Inc()
+		lb.writeError(w, r, http.StatusHTTPVersionNotSupported, reasonConnect, "CONNECT needs HTTP/1.1")
+		return
+	}
+	lbConnectTotal.WithLabelValues("ok").Inc()
+	_ = src.SetDeadline(time.Time{}) // server timeouts do not apply to tunnels
+	if _, err := io.WriteString(src, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		src.Close()
+		dst.Close()
+		return
+	}
+
+	start := time.Now()
+	done := make(chan int64, 1)
+	go func() {
+		// bytes the server already buffered belong to the tunnel too
+		n, _ := io.Copy(dst, buf.Reader)
+		dst.Close()
+		done <- n
+	}()
+	down, _ := io.Copy(src, dst)
+	src.Close()
+	up := <-done
+	log.Printf("[connect] %s -> %s closed after %s (%d bytes up, %d down)",
+		remoteHost(r), target, time.Since(start).Round(time.Millisecond), up, down)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectAllowRejectsOpenWildcards(t *testing.T) {
+	for _, v := range []string{"*:*", "*:443", "*internal:443", "*.:443", "a.*.internal:443"} {
+		if _, err := parseConnectAllow(v); err == nil {
+			t.Errorf("CONNECT_ALLOW=%q accepted", v)
+		}
+	}
+}
+
+func TestConnectAllowedMatching(t *testing.T) {
+	rules, err := parseConnectAllow("git.internal:22,*.svc.internal:443,db.internal:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{ConnectAllow: rules}
+	for dst, want := range map[string]bool{
+		"git.internal:22":       true,
+		"git.internal:23":       false,
+		"api.svc.internal:443":  true,
+		"API.svc.internal:443":  true,
+		"svc.internal:443":      false,
+		"evilsvc.internal:443":  false,
+		"api.svc.internal:80":   false,
+		"db.internal:5432":      true,
+		"db.internal.evil:5432": false,
+	} {
+		if got := lb.connectAllowed(dst); got != want {
+			t.Errorf("connectAllowed(%q) = %t, want %t", dst, got, want)
+		}
+	}
+}
+
+// connectThrough sends a raw CONNECT for dst to the LB at front with the
+// given tenant and returns the status and, on 200, the open tunnel.
+func connectThrough(t *testing.T, front, dst, tenant string) (int, net.Conn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", front)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nX-Tenant-ID: %s\r\n\r\n", dst, dst, tenant)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, conn
+}
+
+func TestConnectTunnelsAndHonoursTenantLimits(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	rules, err := parseConnectAllow(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://127.0.0.1:1"}})
+	lb.ConnectAllow = rules
+	lb.tenants = newTenantLimiter("X-Tenant-Id", map[string]rateLimit{"acme": {RPS: 0.001, Burst: 1}}, rateLimit{}, time.Minute)
+	front := httptest.NewServer(lb)
+	defer front.Close()
+	addr := front.Listener.Addr().String()
+
+	code, tunnel := connectThrough(t, addr, echo.Addr().String(), "acme")
+	if code != http.StatusOK {
+		t.Fatalf("CONNECT status %d, want 200", code)
+	}
+	io.WriteString(tunnel, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("tunnel echoed %q, %v; want ping", buf, err)
+	}
+	tunnel.Close()
+
+	if code, _ := connectThrough(t, addr, echo.Addr().String(), "acme"); code != http.StatusTooManyRequests {
+		t.Errorf("CONNECT over the tenant limit: status %d, want 429", code)
+	}
+	if code, _ := connectThrough(t, addr, "127.0.0.1:1", "other"); code != http.StatusForbidden {
+		t.Errorf("CONNECT to an unlisted destination: status %d, want 403", code)
+	}
+}
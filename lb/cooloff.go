@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ================= Backend Retry-After cool-off ================= */
+
+// errCoolingOff means every alive backend asked for backoff with
+// Retry-After and none has been tried yet; the client gets a 503.
+var errCoolingOff = errors.New("all alive backends cooling off")
+
+// parseRetryAfter reads a Retry-After value in seconds or as an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(n, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// noteRetryAfter starts a cool-off for b when it answers 503 or 429 with
+// Retry-After, capped at BackendRetryAfterMax.
+func (lb *LoadBalancer) noteRetryAfter(b *Backend, resp *http.Response) {
+	if lb.BackendRetryAfterMax <= 0 ||
+		(resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests) {
+		return
+	}
+	now := time.Now()
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok || d == 0 {
+		return
+	}
+	d = min(d, lb.BackendRetryAfterMax)
+	b.coolUntil.Store(now.Add(d).UnixNano())
+	log.Printf("[proxy] %s answered %d with Retry-After; cooling off for %s", b.Name, resp.StatusCode, d)
+}
+
+func (b *Backend) coolingOff(now time.Time) bool {
+	return now.UnixNano() < b.coolUntil.Load()
+}
+
+// skipCooling returns tried plus the backends in p that are
+// cooling off, and how many were added. tried itself is not modified.
+// Caller holds p.mu.
+func (p *Pool) skipCooling(tried map[*Backend]bool) (map[*Backend]bool, int) {
+	now := time.Now()
+	skip, added := tried, 0
+	for _, b := range p.Backends {
+		if tried[b] || !b.coolingOff(now) {
+			continue
+		}
+		if added == 0 {
+			skip = make(map[*Backend]bool, len(tried)+1)
+			for k, v := range tried {
+				skip[k] = v
+			}
+		}
+		skip[b] = true
+		added++
+	}
+	return skip, added
+}
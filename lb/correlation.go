@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+/* ================= Correlation IDs ================= */
+
+// DefaultCorrelationHeader is used when CORRELATION_HEADER is unset.
+const DefaultCorrelationHeader = "X-Correlation-ID"
+
+// correlationID keeps the ID an upstream hop already assigned in header and
+// mints one only when it is missing. The ID is forwarded to backends on the
+// request and echoed to the client on the response.
+func correlationID(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = newCorrelationID()
+			r.Header.Set(header, id)
+		}
+		w.Header().Set(header, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newCorrelationID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
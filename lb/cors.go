@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ================= CORS ================= */
+
+// CORSPolicy is applied at the LB so backends need no CORS handling:
+// preflights are answered here and never proxied, and actual responses
+// get the allow headers (backends' own Access-Control-* are dropped).
+type CORSPolicy struct {
+	Origins     []string // exact origins, or "*" for any
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      time.Duration
+}
+
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	return slices.Contains(p.Origins, "*") || slices.Contains(p.Origins, origin)
+}
+
+// checkCORS rejects a wildcard origin with credentials: echoing any
+// Origin back with Allow-Credentials lets every site read credentialed
+// responses.
+func checkCORS(origins []string, credentials bool) error {
+	if credentials && slices.Contains(origins, "*") {
+		return fmt.Errorf("CORS_CREDENTIALS needs an explicit CORS_ORIGINS list, not *")
+	}
+	return nil
+}
+
+// setOrigin writes Access-Control-Allow-Origin. checkCORS guarantees a
+// wildcard policy is never credentialed.
+func (p *CORSPolicy) setOrigin(h http.Header, origin string) {
+	h.Add("Vary", "Origin")
+	if slices.Contains(p.Origins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// cors wraps next with p; a nil policy returns next unchanged. Requests
+// without an Origin, or from an origin not allowed, pass through bare.
+func cors(p *CORSPolicy, next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !p.allowOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		p.setOrigin(h, origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+			if len(p.Headers) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+			}
+			if p.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripCORS removes a backend's CORS response headers so the LB's set is
+// the only one the client sees.
+func stripCORS(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+}
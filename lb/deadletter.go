@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* ================= Dead-letter ================= */
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops
+// the rest, so teeing a large upload never grows memory unbounded.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); room > 0 {
+		if len(p) > room {
+			c.buf.Write(p[:room])
+			c.truncated = true
+		} else {
+			c.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		c.truncated = true
+	}
+	return len(p), nil
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type deadLetter struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	Host          string      `json:"host"`
+	Path          string      `json:"path"`
+	Query         string      `json:"query,omitempty"`
+	ClientIP      string      `json:"client_ip"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"` // base64 in JSON
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+func newDeadLetter(r *http.Request, clientIP string, status int, body *cappedBuffer) deadLetter {
+	dl := deadLetter{
+		Time: time.Now().UTC(), Method: r.Method, Host: r.Host,
+		Path: r.URL.Path, Query: r.URL.RawQuery, ClientIP: clientIP,
+		Status: status, Header: redactHeader(r.Header),
+	}
+	if body != nil {
+		dl.Body = bytes.Clone(body.buf.Bytes())
+		dl.BodyTruncated = body.truncated
+	}
+	return dl
+}
+
+var deadLetterClient = &http.Client{Timeout: 5 * time.Second}
+
+// sendDeadLetter posts dl to DeadLetterURL; failures are only logged.
+func (lb *LoadBalancer) sendDeadLetter(dl deadLetter) {
+	payload, err := json.Marshal(dl)
+	if err != nil {
+		log.Printf("[deadletter] encode: %v", err)
+		return
+	}
+	resp, err := deadLetterClient.Post(lb.DeadLetterURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("[deadletter] %s %s: %v", dl.Method, dl.Path, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[deadletter] %s %s: status=%d", dl.Method, dl.Path, resp.StatusCode)
+	}
+}
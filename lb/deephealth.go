@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Deep health checks ================= */
+
+var lbDeepHealth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "lb_backend_deep_health", Help: "1 while the backend passes DEEP_HEALTH_PATH, 0 while its weight is degraded"},
+	[]string{"backend"},
+)
+
+func init() { prometheus.MustRegister(lbDeepHealth) }
+
+// StartDeepHealthChecks probes DeepHealthPath on every alive backend each
+// DeepHealthInterval, skipping a backend whose previous deep probe is
+// still running. Unlike the shallow check it never changes Alive: a
+// failing backend keeps serving at a reduced weight (see setDeep), which
+// only weighted selection takes into account.
+func (lb *LoadBalancer) StartDeepHealthChecks() {
+	if lb.DeepHealthPath == "" || lb.DeepHealthInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(lb.DeepHealthInterval)
+	go func() {
+		for range t.C {
+			for _, b := range lb.backends() {
+				if !b.IsAlive() || !b.deepProbing.CompareAndSwap(false, true) {
+					continue
+				}
+				go func(b *Backend) {
+					defer b.deepProbing.Store(false)
+					err := lb.probePath(b, lb.DeepHealthPath, lb.DeepHealthTimeout)
+					lb.setDeep(b, err)
+				}(b)
+			}
+		}
+	}()
+}
+
+// setDeep records a deep check result, logging only when it changes.
+func (lb *LoadBalancer) setDeep(b *Backend, err error) {
+	factor := 1.0
+	if err != nil {
+		factor = lb.DeepHealthWeight
+	}
+	b.mu.Lock()
+	changed := b.deep != factor
+	b.deep = factor
+	b.mu.Unlock()
+	if err != nil {
+		lbDeepHealth.WithLabelValues(b.Name).Set(0)
+	} else {
+		lbDeepHealth.WithLabelValues(b.Name).Set(1)
+	}
+	switch {
+	case !changed:
+	case err != nil:
+		log.Printf("[health] %s deep check failing, weight x%g: %v", b.Name, factor, err)
+	default:
+		log.Printf("[health] %s deep check passing again, full weight", b.Name)
+	}
+}
+
+// resetDeep drops a degraded deep factor when b goes down, so it does not
+// rejoin with a verdict from before the outage. Caller holds b.mu.
+func (b *Backend) resetDeep() {
+	if b.deep != 1 {
+		b.deep = 1
+		lbDeepHealth.WithLabelValues(b.Name).Set(1)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Degraded pools ================= */
+
+var lbPoolDegraded = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "lb_pool_degraded", Help: "1 while the pool's alive fraction is below MIN_HEALTHY_FRACTION"},
+	[]string{"pool"},
+)
+
+func init() { prometheus.MustRegister(lbPoolDegraded) }
+
+// aliveFraction is the share of p's backends currently able to take
+// traffic (0 for an empty pool).
+func (p *Pool) aliveFraction() float64 {
+	members := p.members()
+	if len(members) == 0 {
+		return 0
+	}
+	alive := 0
+	for _, b := range members {
+		if b.IsAlive() {
+			alive++
+		}
+	}
+	return float64(alive) / float64(len(members))
+}
+
+func (p *Pool) setDegraded(degraded bool, fraction float64) {
+	if p.degraded.Swap(degraded) == degraded {
+		return
+	}
+	log.Printf("[pool] %s degraded=%t (%.0f%% of backends alive)", p.Name, degraded, fraction*100)
+	v := 0.0
+	if degraded {
+		v = 1
+	}
+	lbPoolDegraded.WithLabelValues(p.Name).Set(v)
+}
+
+// updateDegraded re-evaluates every pool against MinHealthyFraction. It
+// runs on the health-check tick.
+func (lb *LoadBalancer) updateDegraded() {
+	if lb.MinHealthyFraction <= 0 {
+		return
+	}
+	for _, p := range lb.allPools() {
+		f := p.aliveFraction()
+		p.setDegraded(f < lb.MinHealthyFraction, f)
+	}
+}
+
+// shedDegraded answers 503 for requests matching DegradedShedPaths while
+// pool is degraded, keeping the surviving backends for critical traffic.
+func (lb *LoadBalancer) shedDegraded(w http.ResponseWriter, r *http.Request, pool *Pool) bool {
+	if !pool.degraded.Load() {
+		return false
+	}
+	if _, ok := matchPathRules(lb.DegradedShedPaths, r.URL.Path); !ok {
+		return false
+	}
+	lb.writeError(w, r, http.StatusServiceUnavailable, reasonDegraded, "shedding non-critical traffic")
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ================= Backend dialing ================= */
+
+const (
+	DialDualStack = "dual" // Happy Eyeballs across IPv4 and IPv6
+	DialIPv4      = "ipv4"
+	DialIPv6      = "ipv6"
+)
+
+// dialContext is the DialContext of every backend transport. It reads the
+// dial settings at dial time, so they can be set after backends are built.
+func (lb *LoadBalancer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:       lb.DialTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: lb.DialFallbackDelay,
+	}
+	switch {
+	case network == "unix":
+	case lb.DialMode == DialIPv4:
+		network = "tcp4"
+	case lb.DialMode == DialIPv6:
+		network = "tcp6"
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// agedRetryInterval is how often an expired connection that was busy at
+// expiry is looked at again.
+const agedRetryInterval = time.Second
+
+// agedConn retires a keep-alive connection once it is older than a TTL.
+// http.Transport has no max-lifetime option and keeps its idle pool
+// private, so on expiry the backend's idle connections are closed, and
+// again every agedRetryInterval until this one has gone. Only idle
+// connections are ever closed: a request in flight is never cut off, and
+// a connection that never goes idle (a busy HTTP/2 stream) lives on.
+// Younger idle connections closed alongside are simply redialled.
+type agedConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func newAgedConn(c net.Conn, ttl time.Duration, closeIdle func()) *agedConn {
+	ac := &agedConn{Conn: c}
+	var retire func()
+	retire = func() {
+		if ac.closed.Load() {
+			return
+		}
+		closeIdle()
+		time.AfterFunc(agedRetryInterval, retire)
+	}
+	time.AfterFunc(ttl, retire)
+	return ac
+}
+
+func (c *agedConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// connStats counts one backend's connections for /admin/debug/stats;
+// http.Transport keeps its pool private.
+type connStats struct {
+	open   atomic.Int64 // currently open
+	dialed atomic.Int64 // opened in total
+	reused atomic.Int64 // requests sent on an already-open connection
+}
+
+// dialFor is b's DialContext: lb.dialContext plus connection counting and
+// MaxConnAge. A Unix socket backend dials its socket whatever address is
+// asked for.
+func (lb *LoadBalancer) dialFor(b *Backend) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if b.socket != "" {
+			network, addr = "unix", b.socket
+		}
+		conn, err := lb.dialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if lb.MaxConnAge > 0 {
+			conn = newAgedConn(conn, lb.MaxConnAge, b.transport.CloseIdleConnections)
+		}
+		b.conns.dialed.Add(1)
+		b.conns.open.Add(1)
+		return &countedConn{Conn: conn, open: &b.conns.open}, nil
+	}
+}
+
+// probeDialFor is b's health probe DialContext: lb.dialContext to the
+// backend's address or socket, without counting or aging the connection.
+func (lb *LoadBalancer) probeDialFor(b *Backend) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if b.socket != "" {
+			network, addr = "unix", b.socket
+		}
+		return lb.dialContext(ctx, network, addr)
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+func parseDialMode(v string) (string, error) {
+	switch v {
+	case DialDualStack, DialIPv4, DialIPv6:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown dial mode %q (want dual, ipv4 or ipv6)", v)
+}
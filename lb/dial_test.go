@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAgedConnRetiresAfterTTL(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the first sweep finds the connection busy; the retry closes it
+	var calls atomic.Int32
+	var ac atomic.Pointer[agedConn]
+	ac.Store(newAgedConn(client, 50*time.Millisecond, func() {
+		if calls.Add(1) == 2 {
+			ac.Load().Close()
+		}
+	}))
+
+	time.Sleep(25 * time.Millisecond)
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("closeIdle called %d times before the TTL", n)
+	}
+	deadline := time.Now().Add(agedRetryInterval + time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("closeIdle called %d times, want a retry after the first sweep", n)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("connection still writable after retirement")
+	}
+
+	time.Sleep(agedRetryInterval + 200*time.Millisecond)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("closeIdle called %d times after the connection closed, want retries to stop", n)
+	}
+}
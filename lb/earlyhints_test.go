@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+// earlyHints sends 103 Early Hints with a preload Link, then a final
+// response with the given status.
+func earlyHints(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		if status != http.StatusOK {
+			http.Error(w, "failing", status)
+			return
+		}
+		io.WriteString(w, "ok")
+	}
+}
+
+// getWithHints fetches url and returns the final response (body read)
+// and the Link headers of every 103 received before it.
+func getWithHints(t *testing.T, url string) (*http.Response, string, []string) {
+	t.Helper()
+	var links []string
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+		if code == http.StatusEarlyHints {
+			links = append(links, h.Get("Link"))
+		}
+		return nil
+	}}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body), links
+}
+
+func TestEarlyHintsForwarded(t *testing.T) {
+	h := newHandlerHarness(t, earlyHints(http.StatusOK))
+
+	resp, body, links := getWithHints(t, h.front.URL)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("final response %d %q, want 200 %q", resp.StatusCode, body, "ok")
+	}
+	if len(links) != 1 || links[0] != "</app.css>; rel=preload; as=style" {
+		t.Errorf("early hints Link = %q, want one preload hint", links)
+	}
+}
+
+func TestEarlyHintsDoNotBlockRetry(t *testing.T) {
+	h := newHandlerHarness(t, earlyHints(http.StatusInternalServerError), earlyHints(http.StatusOK))
+
+	// round-robin starts after index 0, so point it at the failing backend
+	h.lb.pool.current = len(h.lb.pool.Backends) - 1
+	resp, body, _ := getWithHints(t, h.front.URL)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("final response %d %q, want the retry's 200 %q", resp.StatusCode, body, "ok")
+	}
+	if failing, healthy := h.backends[0].hits.Load(), h.backends[1].hits.Load(); failing != 1 || healthy != 1 {
+		t.Errorf("hits failing=%d healthy=%d, want one each", failing, healthy)
+	}
+}
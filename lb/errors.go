@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* ================= LB error responses ================= */
+
+// Reasons for errors the LB answers itself, sent in X-LB-Error-Reason and
+// in JSON error bodies so clients and CDNs can tell them from backend
+// errors and react (e.g. retry elsewhere on no-upstream).
+const (
+	reasonNoUpstream   = "no-upstream"
+	reasonUpstream     = "upstream-error"
+	reasonUpstreamCode = "upstream-status"
+	reasonTimeout      = "timeout"
+	reasonBodyTooLarge = "body-too-large"
+	reasonBadBody      = "bad-request-body"
+	reasonDenied       = "denied"
+	reasonMethod       = "method-not-allowed"
+	reasonPinned       = "pinned-backend"
+	reasonDegraded     = "degraded"
+	reasonRateLimited  = "rate-limited"
+	reasonHTTP10       = "http10-rejected"
+	reasonConnect      = "connect-refused"
+)
+
+const (
+	ErrorFormatText = "text"
+	ErrorFormatJSON = "json"
+)
+
+func parseErrorFormat(v string) (string, error) {
+	switch v {
+	case ErrorFormatText, ErrorFormatJSON:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown error format %q (want text or json)", v)
+}
+
+// parseErrorHeaders parses ERROR_HEADERS: comma-separated "Name=value"
+// pairs added to every LB-generated error response.
+func parseErrorHeaders(v string) (http.Header, error) {
+	h := http.Header{}
+	for _, pair := range splitList(v) {
+		k, val, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid header %q: want Name=value", pair)
+		}
+		h.Set(strings.TrimSpace(k), strings.TrimSpace(val))
+	}
+	return h, nil
+}
+
+// errorPage is a static body served for one status code.
+type errorPage struct {
+	body        []byte
+	contentType string
+}
+
+// loadErrorPages reads ERROR_PAGES, comma-separated "code=file" pairs
+// such as "502=/etc/lb/502.html,503=/etc/lb/maintenance.html". The
+// content type comes from the file extension, else the content.
+func loadErrorPages(v string) (map[int]errorPage, error) {
+	pages := map[int]errorPage{}
+	for _, pair := range splitList(v) {
+		k, file, ok := strings.Cut(pair, "=")
+		code, err := strconv.Atoi(strings.TrimSpace(k))
+		if !ok || err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid page %q: want <status>=<file>", pair)
+		}
+		file = strings.TrimSpace(file)
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ct := mime.TypeByExtension(filepath.Ext(file))
+		if ct == "" {
+			ct = http.DetectContentType(body)
+		}
+		pages[code] = errorPage{body: body, contentType: ct}
+	}
+	return pages, nil
+}
+
+// writeError answers r with an error generated by the LB itself rather
+// than a backend: ErrorHeaders and X-LB-Error-Reason are set. The body is
+// the ErrorPages entry for code if there is one, else msg as plain text
+// or, with ErrorFormat json, {"error","reason","request_id"}.
+func (lb *LoadBalancer) writeError(w http.ResponseWriter, r *http.Request, code int, reason, msg string) {
+	h := w.Header()
+	for k, v := range lb.ErrorHeaders {
+		h[k] = v
+	}
+	h.Set("X-LB-Error-Reason", reason)
+	if page, ok := lb.ErrorPages[code]; ok {
+		h.Del("Content-Length")
+		h.Set("Content-Type", page.contentType)
+		h.Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+		_, _ = w.Write(page.body)
+		return
+	}
+	if lb.ErrorFormat != ErrorFormatJSON {
+		http.Error(w, msg, code)
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	body := map[string]string{"error": msg, "reason": reason}
+	if lb.RequestIDHeader != "" {
+		if id := r.Header.Get(lb.RequestIDHeader); id != "" {
+			body["request_id"] = id
+		}
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Weight fairness ================= */
+
+var lbShareDrift = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "lb_backend_share_drift", Help: "Observed minus configured share of the pool's attempts over the last FAIRNESS_WINDOW"},
+	[]string{"backend"},
+)
+
+func init() { prometheus.MustRegister(lbShareDrift) }
+
+// fairnessRow compares one backend's share of its pool's attempts in a
+// window with the share its configured weight entitles it to.
+type fairnessRow struct {
+	Backend  string  `json:"backend"`
+	Pool     string  `json:"pool"`
+	Weight   int     `json:"weight"`
+	Attempts int64   `json:"attempts"`
+	Expected float64 `json:"expected_share"`
+	Observed float64 `json:"observed_share"`
+	Drift    float64 `json:"drift"`
+}
+
+type fairnessReport struct {
+	Window string        `json:"window"`
+	Ended  time.Time     `json:"ended"`
+	Rows   []fairnessRow `json:"rows"`
+}
+
+// StartFairness closes a window every FairnessWindow, publishing each
+// backend's drift from its configured weight. Pools with no attempts in a
+// window have nothing to compare and are left out.
+func (lb *LoadBalancer) StartFairness() {
+	if lb.FairnessWindow <= 0 {
+		return
+	}
+	t := time.NewTicker(lb.FairnessWindow)
+	go func() {
+		for now := range t.C {
+			lb.fairness.Store(lb.closeFairnessWindow(now))
+		}
+	}()
+}
+
+func (lb *LoadBalancer) closeFairnessWindow(now time.Time) *fairnessReport {
+	rep := &fairnessReport{Window: lb.FairnessWindow.String(), Ended: now}
+	for _, p := range lb.allPools() {
+		members := p.members()
+		counts := make([]int64, len(members))
+		var total int64
+		weights := 0
+		for i, b := range members {
+			counts[i] = b.windowAttempts.Swap(0)
+			total += counts[i]
+			weights += b.Weight
+		}
+		if total == 0 || weights == 0 {
+			continue
+		}
+		for i, b := range members {
+			row := fairnessRow{
+				Backend: b.Name, Pool: p.Name, Weight: b.Weight, Attempts: counts[i],
+				Expected: float64(b.Weight) / float64(weights),
+				Observed: float64(counts[i]) / float64(total),
+			}
+			row.Drift = row.Observed - row.Expected
+			lbShareDrift.WithLabelValues(b.Name).Set(row.Drift)
+			rep.Rows = append(rep.Rows, row)
+		}
+	}
+	return rep
+}
+
+// adminFairness serves the last closed window (null before the first).
+func (lb *LoadBalancer) adminFairness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(lb.fairness.Load())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+/* ================= Path deny-list ================= */
+
+// pathRule matches a request path either by glob (path.Match semantics,
+// also matching any path below it) or by regexp when prefixed with "re:".
+type pathRule struct {
+	raw  string
+	glob string
+	re   *regexp.Regexp
+}
+
+func parsePathRules(v string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, p := range splitList(v) {
+		if expr, ok := strings.CutPrefix(p, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path regexp %q: %v", expr, err)
+			}
+			rules = append(rules, pathRule{raw: p, re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid path glob %q: %v", p, err)
+		}
+		rules = append(rules, pathRule{raw: p, glob: p})
+	}
+	return rules, nil
+}
+
+func (pr pathRule) match(p string) bool {
+	if pr.re != nil {
+		return pr.re.MatchString(p)
+	}
+	// "/.git" should also cover "/.git/config": try the path and each parent.
+	for p = path.Clean("/" + p); ; p = path.Dir(p) {
+		if ok, _ := path.Match(pr.glob, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+func rawRules(rules []pathRule) []string {
+	out := make([]string, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, r.raw)
+	}
+	return out
+}
+
+func matchPathRules(rules []pathRule, p string) (pathRule, bool) {
+	for _, r := range rules {
+		if r.match(p) {
+			return r, true
+		}
+	}
+	return pathRule{}, false
+}
+
+// denied reports whether r hits the deny-list, answering 403 if so.
+func (lb *LoadBalancer) denied(w http.ResponseWriter, r *http.Request) bool {
+	rule, ok := matchPathRules(lb.DenyPaths, r.URL.Path)
+	if !ok {
+		return false
+	}
+	log.Printf("[deny] %s %s from %s matched %q", r.Method, r.URL.Path, lb.clientIP(r), rule.raw)
+	lbDeniedTotal.WithLabelValues(rule.raw).Inc()
+	lb.writeError(w, r, http.StatusForbidden, reasonDenied, "forbidden")
+	return true
+}
+
+// denyPaths applies the deny-list in front of next. main wraps the whole
+// client-facing mux with it, so /admin, /metrics and pprof are covered as
+// well as proxied requests.
+func (lb *LoadBalancer) denyPaths(next http.Handler) http.Handler {
+	if len(lb.DenyPaths) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lb.denied(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+/* ================= Method filter ================= */
+
+// methodAllowed reports whether r's method is in AllowedMethods (always
+// true when the list is empty), answering 405 with an Allow header if not.
+func (lb *LoadBalancer) methodAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if len(lb.AllowedMethods) == 0 || slices.Contains(lb.AllowedMethods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(lb.AllowedMethods, ", "))
+	lb.writeError(w, r, http.StatusMethodNotAllowed, reasonMethod, "method not allowed")
+	return false
+}
+
+/* ================= Basic auth ================= */
+
+// basicAuth guards paths matching rules with HTTP Basic credentials. It wraps
+// the whole mux so it covers /metrics and /admin as well as proxied routes.
+func basicAuth(rules []pathRule, user, pass string, next http.Handler) http.Handler {
+	if len(rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := matchPathRules(rules, r.URL.Path); ok {
+			u, p, ok := r.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="lb", charset="UTF-8"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
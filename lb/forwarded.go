@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Forwarded header sanitization ================= */
+
+const (
+	// ForwardedTrusted (default) drops client-supplied forwarding headers
+	// unless the direct peer is in TrustedProxies.
+	ForwardedTrusted = "trusted"
+	// ForwardedStrip always drops them.
+	ForwardedStrip = "strip"
+	// ForwardedKeep passes them through untouched.
+	ForwardedKeep = "keep"
+)
+
+// forwardedHeaders are the hop headers a client could use to spoof what
+// the LB reports about the original request. X-Forwarded-For is not here:
+// it is rebuilt from clientIP on every attempt.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Forwarded-Server",
+	"X-Real-IP",
+}
+
+var lbForwardedStripped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_forwarded_headers_stripped_total", Help: "Client-supplied forwarding headers dropped, per proxied attempt"},
+	[]string{"header"},
+)
+
+func init() { prometheus.MustRegister(lbForwardedStripped) }
+
+func parseForwardedPolicy(v string) (string, error) {
+	switch v {
+	case ForwardedTrusted, ForwardedStrip, ForwardedKeep:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown policy %q (want %s, %s or %s)", v, ForwardedTrusted, ForwardedStrip, ForwardedKeep)
+}
+
+// sanitizeForwarded applies ForwardedPolicy to h, the outgoing copy of
+// r's headers, before the LB sets its own forwarding headers.
+func (lb *LoadBalancer) sanitizeForwarded(h http.Header, r *http.Request) {
+	switch lb.ForwardedPolicy {
+	case ForwardedKeep:
+		return
+	case ForwardedTrusted:
+		if lb.isTrusted(net.ParseIP(remoteHost(r))) {
+			return
+		}
+	}
+	for _, name := range forwardedHeaders {
+		if len(h.Values(name)) > 0 {
+			h.Del(name)
+			lbForwardedStripped.WithLabelValues(name).Inc()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSanitizeForwarded(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy string
+		peer   string
+		kept   bool
+	}{
+		{ForwardedKeep, "203.0.113.9:4000", true},
+		{ForwardedStrip, "10.0.0.5:4000", false},
+		{ForwardedStrip, "203.0.113.9:4000", false},
+		{ForwardedTrusted, "10.0.0.5:4000", true},
+		{ForwardedTrusted, "203.0.113.9:4000", false},
+	}
+	for _, tt := range tests {
+		lb := &LoadBalancer{ForwardedPolicy: tt.policy, TrustedProxies: trusted}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		h := r.Header.Clone()
+		for _, name := range forwardedHeaders {
+			h.Set(name, "spoofed")
+		}
+		h.Set("X-Forwarded-For", "198.51.100.1")
+		h.Set("X-Request-Id", "abc")
+
+		lb.sanitizeForwarded(h, r)
+		for _, name := range forwardedHeaders {
+			if got := h.Get(name) != ""; got != tt.kept {
+				t.Errorf("policy %s, peer %s: %s kept = %t, want %t", tt.policy, tt.peer, name, got, tt.kept)
+			}
+		}
+		if h.Get("X-Forwarded-For") == "" || h.Get("X-Request-Id") == "" {
+			t.Errorf("policy %s, peer %s: dropped a header outside forwardedHeaders", tt.policy, tt.peer)
+		}
+	}
+}
@@ -2,4 +2,7 @@ module demo/lb
 
 go 1.22
 
-require github.com/prometheus/client_golang v1.19.0
+require (
+	github.com/prometheus/client_golang v1.19.0
+	google.golang.org/grpc v1.65.0
+)
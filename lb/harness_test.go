@@ -0,0 +1,280 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run with the race detector: go test -race ./...
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testBackend is an in-process backend that counts hits and can be told
+// to answer 500, or to drop the connection unanswered, until it is healed.
+// Otherwise it answers "ok", or runs its handler when it has one.
+type testBackend struct {
+	*httptest.Server
+	hits     atomic.Int64
+	failing  atomic.Bool
+	dropping atomic.Bool
+}
+
+func newTestBackend(handler http.HandlerFunc) *testBackend {
+	tb := &testBackend{}
+	tb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tb.hits.Add(1)
+		if tb.dropping.Load() {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if tb.failing.Load() {
+			http.Error(w, "failing", http.StatusInternalServerError)
+			return
+		}
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	return tb
+}
+
+// harness is a LoadBalancer in front of n test backends, itself served by
+// an httptest.Server. Health checks are not started; tests drive state.
+type harness struct {
+	t        *testing.T
+	lb       *LoadBalancer
+	front    *httptest.Server
+	backends []*testBackend
+}
+
+func newHarness(t *testing.T, n int) *harness {
+	t.Helper()
+	return newHandlerHarness(t, make([]http.HandlerFunc, n)...)
+}
+
+// newHandlerHarness is newHarness with one backend per handler; a nil
+// handler gives the default "ok" backend.
+func newHandlerHarness(t *testing.T, handlers ...http.HandlerFunc) *harness {
+	t.Helper()
+	h := &harness{t: t}
+	var cfgs []BackendConfig
+	for _, handler := range handlers {
+		tb := newTestBackend(handler)
+		t.Cleanup(tb.Close)
+		h.backends = append(h.backends, tb)
+		cfgs = append(cfgs, BackendConfig{URL: tb.URL})
+	}
+	h.lb = NewLoadBalancer(cfgs)
+	h.front = httptest.NewServer(h.lb)
+	t.Cleanup(h.front.Close)
+	return h
+}
+
+// get sends one request through the LB and returns its status code.
+func (h *harness) get() int {
+	h.t.Helper()
+	resp, err := http.Get(h.front.URL + "/")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func breakerOf(b *Backend) breakerState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.breaker
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	h := newHarness(t, 3)
+	for i := 0; i < 30; i++ {
+		if code := h.get(); code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, code)
+		}
+	}
+	for i, tb := range h.backends {
+		if got := tb.hits.Load(); got != 10 {
+			t.Errorf("backend %d got %d hits, want 10", i, got)
+		}
+	}
+}
+
+func TestFailoverOnKilledBackend(t *testing.T) {
+	h := newHarness(t, 3)
+	h.backends[1].Close()
+	for i := 0; i < 30; i++ {
+		if code := h.get(); code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want failover to a live backend", i, code)
+		}
+	}
+	if h.lb.Backends[1].IsAlive() {
+		t.Error("killed backend still alive after repeated failures")
+	}
+}
+
+func TestBreakerOpensAfterMaxConsecFail(t *testing.T) {
+	h := newHarness(t, 1)
+	h.lb.MaxRetries = 0
+	h.backends[0].failing.Store(true)
+	b := h.lb.Backends[0]
+
+	for i := 0; i < h.lb.MaxConsecFail-1; i++ {
+		h.get()
+		if !b.IsAlive() {
+			t.Fatalf("breaker opened after %d failures, want %d", i+1, h.lb.MaxConsecFail)
+		}
+	}
+	if code := h.get(); code != http.StatusInternalServerError {
+		t.Errorf("status %d, want the backend's 500", code)
+	}
+	if b.IsAlive() || breakerOf(b) != breakerOpen {
+		t.Fatalf("breaker not open after %d failures", h.lb.MaxConsecFail)
+	}
+	if code := h.get(); code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with breaker open, want 503", code)
+	}
+}
+
+func TestBreakerRecoversAfterCooldown(t *testing.T) {
+	h := newHarness(t, 1)
+	h.lb.MaxRetries = 0
+	h.lb.BreakerCooldown = 50 * time.Millisecond
+	h.backends[0].failing.Store(true)
+	b := h.lb.Backends[0]
+	for i := 0; i < h.lb.MaxConsecFail; i++ {
+		h.get()
+	}
+	if b.IsAlive() {
+		t.Fatal("breaker did not open")
+	}
+
+	h.backends[0].failing.Store(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.IsAlive() {
+		if time.Now().After(deadline) {
+			t.Fatal("backend not back after cooldown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := breakerOf(b); st != breakerHalfOpen {
+		t.Fatalf("breaker state %d after cooldown, want half-open", st)
+	}
+	if code := h.get(); code != http.StatusOK {
+		t.Fatalf("trial request status %d, want 200", code)
+	}
+	if st := breakerOf(b); st != breakerClosed {
+		t.Errorf("breaker state %d after successful trial, want closed", st)
+	}
+}
+
+func TestRetriesStopWhenBackendsExhausted(t *testing.T) {
+	h := newHarness(t, 2)
+	h.lb.MaxRetries = 3 // more than there are distinct backends
+	h.lb.MaxConsecFail = 100
+	for _, tb := range h.backends {
+		tb.failing.Store(true)
+	}
+	if code := h.get(); code != http.StatusInternalServerError {
+		t.Errorf("status %d, want the backends' 500", code)
+	}
+	for i, tb := range h.backends {
+		if got := tb.hits.Load(); got != 1 {
+			t.Errorf("backend %d got %d attempts, want exactly 1", i, got)
+		}
+	}
+}
+
+// With backends exhausted before the retry budget, the last backend's 5xx
+// still passes through verbatim rather than as the LB's own error.
+func TestLastBackendErrorPassesThrough(t *testing.T) {
+	for _, retryAll := range []bool{false, true} {
+		h := newHarness(t, 2)
+		h.lb.MaxRetries = 3
+		h.lb.RetryAllBackends = retryAll
+		h.lb.MaxConsecFail = 100
+		for _, tb := range h.backends {
+			tb.failing.Store(true)
+		}
+		resp, err := http.Get(h.front.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || string(body) != "failing\n" {
+			t.Errorf("retryAll=%t: got %d %q, want the backend's own 500 %q", retryAll, resp.StatusCode, body, "failing\n")
+		}
+		if reason := resp.Header.Get("X-LB-Error-Reason"); reason != "" {
+			t.Errorf("retryAll=%t: X-LB-Error-Reason %q on a passed-through response", retryAll, reason)
+		}
+	}
+}
+
+// When no attempt got a response at all, the client sees the LB's own 502
+// rather than an empty 200.
+func TestUnansweredAttemptsEndIn502(t *testing.T) {
+	h := newHarness(t, 2)
+	h.lb.MaxRetries = 3
+	h.lb.MaxConsecFail = 100
+	for _, tb := range h.backends {
+		tb.dropping.Store(true)
+	}
+	resp, err := http.Get(h.front.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status %d, want 502", resp.StatusCode)
+	}
+	if reason := resp.Header.Get("X-LB-Error-Reason"); reason != reasonUpstream {
+		t.Errorf("X-LB-Error-Reason %q, want %q", reason, reasonUpstream)
+	}
+	for i, tb := range h.backends {
+		if got := tb.hits.Load(); got != 1 {
+			t.Errorf("backend %d got %d attempts, want exactly 1", i, got)
+		}
+	}
+}
+
+// TotalTimeout caps the whole request: an attempt's own deadline shrinks
+// to what is left of the budget rather than running its full ReqTimeout.
+func TestTotalTimeoutShrinksAttemptDeadline(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			w.Write([]byte("late"))
+		case <-r.Context().Done():
+		}
+	}
+	h := newHandlerHarness(t, slow, slow)
+	h.lb.ReqTimeout = 5 * time.Second
+	h.lb.TotalTimeout = 200 * time.Millisecond
+	h.lb.MaxRetries = 3
+	h.lb.MaxConsecFail = 100
+
+	start := time.Now()
+	if code := h.get(); code != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want 504 once the total budget is spent", code)
+	}
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("request took %v, want about the 200ms total budget", elapsed)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+/* ================= Consistent hashing ================= */
+
+// ringReplicas is the number of virtual nodes per unit of backend weight;
+// more replicas give a smoother key distribution at the cost of a bigger
+// ring.
+const ringReplicas = 160
+
+type ringNode struct {
+	hash uint32
+	idx  int // index into Pool.Backends
+}
+
+// hashRing places every backend of a pool at ringReplicas x Weight points
+// on a 32-bit circle, so each owns a share of the keyspace proportional to
+// its weight (none at weight 0). A key maps to the first node clockwise of
+// its hash, so when a backend drops only the keys it owned move.
+type hashRing struct {
+	nodes []ringNode
+}
+
+// hashKey is FNV-1a finished with murmur3's fmix32: on its own FNV-1a
+// leaves the near-identical "name#N" point labels clustered, skewing
+// shares well away from the weights.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+func newHashRing(backends []*Backend) *hashRing {
+	total := 0
+	for _, b := range backends {
+		total += b.Weight
+	}
+	r := &hashRing{nodes: make([]ringNode, 0, total*ringReplicas)}
+	for i, b := range backends {
+		// a weight change keeps the existing points and adds or drops
+		// the ones past them, so only the difference in keys moves
+		for v := 0; v < b.Weight*ringReplicas; v++ {
+			r.nodes = append(r.nodes, ringNode{hash: hashKey(b.Name + "#" + strconv.Itoa(v)), idx: i})
+		}
+	}
+	sort.Slice(r.nodes, func(a, b int) bool { return r.nodes[a].hash < r.nodes[b].hash })
+	return r
+}
+
+// walk calls visit for each distinct backend index clockwise from key's
+// position, stopping when visit returns true.
+func (r *hashRing) walk(key string, visit func(idx int) bool) {
+	if len(r.nodes) == 0 {
+		return
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].hash >= h })
+	seen := map[int]bool{}
+	for i := 0; i < len(r.nodes); i++ {
+		n := r.nodes[(start+i)%len(r.nodes)]
+		if seen[n.idx] {
+			continue
+		}
+		seen[n.idx] = true
+		if visit(n.idx) {
+			return
+		}
+	}
+}
+
+// errAllTried means alive backends exist but every one was already
+// attempted for this request.
+var errAllTried = errors.New("all alive backends already tried")
+
+// errHashDepth means every backend within HashFallbackDepth of the key is
+// down, even though others further round the ring may be alive.
+var errHashDepth = errors.New("no alive backend within hash fallback depth")
+
+// nextHashed returns the first alive, untried backend owning key on the
+// ring. Failover is deterministic: the same key always walks the same
+// ordered fallback list, so clients of a down backend share one fallback.
+// depth > 0 limits the walk to that many backends (down ones included).
+// Caller holds p.mu.
+func (p *Pool) nextHashed(key string, depth int, tried map[*Backend]bool) (*Backend, int, error) {
+	if p.ring == nil {
+		p.ring = newHashRing(p.Backends)
+	}
+	pick, alive, walked := -1, false, 0
+	p.ring.walk(key, func(idx int) bool {
+		if depth > 0 && walked == depth {
+			return true
+		}
+		walked++
+		if !p.Backends[idx].IsAlive() {
+			return false
+		}
+		alive = true
+		if tried[p.Backends[idx]] {
+			return false
+		}
+		pick = idx
+		return true
+	})
+	if pick < 0 {
+		if alive {
+			return nil, -1, errAllTried
+		}
+		if depth > 0 && walked == depth && walked < len(p.Backends) {
+			return nil, -1, errHashDepth
+		}
+		return nil, -1, errNoAlive
+	}
+	return p.Backends[pick], pick, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func ringBackends(weights map[string]int, names ...string) []*Backend {
+	var bs []*Backend
+	for _, n := range names {
+		bs = append(bs, &Backend{Name: n, Weight: weights[n]})
+	}
+	return bs
+}
+
+// owners maps each of n keys to the name of the backend owning it.
+func owners(backends []*Backend, n int) []string {
+	r := newHashRing(backends)
+	out := make([]string, n)
+	for i := range out {
+		r.walk("key-"+strconv.Itoa(i), func(idx int) bool {
+			out[i] = backends[idx].Name
+			return true
+		})
+	}
+	return out
+}
+
+func TestHashRingSharesTrackWeights(t *testing.T) {
+	weights := map[string]int{"a:80": 1, "b:80": 2, "c:80": 3, "d:80": 0}
+	const keys = 60000
+	counts := map[string]int{}
+	for _, name := range owners(ringBackends(weights, "a:80", "b:80", "c:80", "d:80"), keys) {
+		counts[name]++
+	}
+	for name, w := range weights {
+		got, want := float64(counts[name])/keys, float64(w)/6
+		if math.Abs(got-want) > 0.03 {
+			t.Errorf("%s (weight %d) owns %.3f of keys, want %.3f ± 0.03", name, w, got, want)
+		}
+	}
+}
+
+func TestHashRingRemapsOnlyTheChangedBackend(t *testing.T) {
+	weights := map[string]int{"a:80": 1, "b:80": 1, "c:80": 1, "d:80": 1}
+	const keys = 20000
+	before := owners(ringBackends(weights, "a:80", "b:80", "c:80"), keys)
+
+	added := owners(ringBackends(weights, "a:80", "b:80", "c:80", "d:80"), keys)
+	moved := 0
+	for i := range before {
+		if added[i] != before[i] {
+			moved++
+			if added[i] != "d:80" {
+				t.Fatalf("key %d moved %s -> %s when only d:80 was added", i, before[i], added[i])
+			}
+		}
+	}
+	if share := float64(moved) / keys; math.Abs(share-0.25) > 0.03 {
+		t.Errorf("adding a fourth backend moved %.3f of keys, want about 0.25", share)
+	}
+
+	removed := owners(ringBackends(weights, "a:80", "c:80"), keys)
+	for i := range before {
+		if removed[i] != before[i] && before[i] != "b:80" {
+			t.Fatalf("key %d moved %s -> %s when only b:80 was removed", i, before[i], removed[i])
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/* ================= gRPC health checks ================= */
+
+// probeGRPC calls grpc.health.v1.Health/Check on the backend's host and
+// treats anything but SERVING as unhealthy.
+func (lb *LoadBalancer) probeGRPC(b *Backend) error {
+	addr := b.URL.Host
+	if b.socket != "" {
+		addr = "unix://" + b.socket
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lb.HealthTimeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: lb.GRPCService})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc status=%s", resp.GetStatus())
+	}
+	return nil
+}
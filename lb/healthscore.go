@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Health score ================= */
+
+// healthScoreAlpha is the EWMA smoothing factor for probe results: each
+// probe moves the score ~30% of the way toward its own verdict.
+const healthScoreAlpha = 0.3
+
+// weightScale gives effective weights enough resolution that a score of
+// e.g. 0.35 on weight 1 still differs from 0.4.
+const weightScale = 100
+
+var lbHealthScore = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "lb_backend_health_score", Help: "Probe-derived health score (0..1) scaling the backend's weight"},
+	[]string{"backend"},
+)
+
+func init() { prometheus.MustRegister(lbHealthScore) }
+
+// scoreProbe folds one probe into b's health score. The score is the
+// smoothed success rate times a latency factor, min(1, target/latency),
+// so a backend that answers slower than HealthLatencyTarget loses weight
+// in proportion. Failures still eject the backend through Alive.
+func (lb *LoadBalancer) scoreProbe(b *Backend, ok bool, latency float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	success := 0.0
+	if ok {
+		success = 1
+		b.probeLatency = (1-healthScoreAlpha)*b.probeLatency + healthScoreAlpha*latency
+	}
+	b.probeSuccess = (1-healthScoreAlpha)*b.probeSuccess + healthScoreAlpha*success
+	factor := 1.0
+	if target := lb.HealthLatencyTarget.Seconds(); target > 0 && b.probeLatency > target {
+		factor = target / b.probeLatency
+	}
+	b.score = math.Max(lb.HealthScoreFloor, b.probeSuccess*factor)
+	lbHealthScore.WithLabelValues(b.Name).Set(b.score)
+}
+
+// recordLoad reads the utilization a backend reports in LoadHeader
+// (0 = idle, 1 = saturated) and folds it into b's smoothed load. A
+// response without the header counts as idle, so a backend that stops
+// reporting does not keep its last load forever. The header is internal
+// and is removed from the client response.
+func (lb *LoadBalancer) recordLoad(b *Backend, h http.Header) {
+	load := 0.0
+	if v := h.Get(lb.LoadHeader); v != "" {
+		h.Del(lb.LoadHeader)
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) {
+			return
+		}
+		load = math.Min(1, math.Max(0, f))
+	}
+	b.mu.Lock()
+	b.load = (1-healthScoreAlpha)*b.load + healthScoreAlpha*load
+	b.mu.Unlock()
+}
+
+// effectiveWeight is the weight used by weighted selection: the configured
+// weight scaled by the health score, by the headroom (1 - load) the
+// backend reports, by its failure decay and by a failing deep check. It
+// is never rounded down to zero for a backend with a positive configured
+// weight.
+func (b *Backend) effectiveWeight() int {
+	if b.Weight <= 0 {
+		return 0
+	}
+	b.mu.RLock()
+	score, load, decay, deep := b.score, b.load, b.decay, b.deep
+	b.mu.RUnlock()
+	return max(1, int(float64(b.Weight*weightScale)*score*(1-load)*decay*deep))
+}
+
+// usesWeights reports whether selection can reach effectiveWeight: only
+// weighted_round_robin, directly or as an adaptive delegate, reads it.
+// Under any other strategy the factors it applies have no effect.
+func (lb *LoadBalancer) usesWeights() bool {
+	if lb.Strategy == StrategyAdaptive {
+		return lb.AdaptiveLow == StrategyWeightedRoundRobin || lb.AdaptiveHigh == StrategyWeightedRoundRobin
+	}
+	return lb.Strategy == StrategyWeightedRoundRobin
+}
+
+// decayWeight shrinks b's decay factor after a request failure, down to
+// WeightDecayFloor. Caller holds b.mu.
+func (lb *LoadBalancer) decayWeight(b *Backend) {
+	if lb.WeightDecay > 0 {
+		b.decay = math.Max(lb.WeightDecayFloor, b.decay*lb.WeightDecay)
+	}
+}
+
+// recoverWeight restores WeightRecovery of b's decay factor after a
+// successful request. Caller holds b.mu.
+func (lb *LoadBalancer) recoverWeight(b *Backend) {
+	if lb.WeightDecay > 0 {
+		b.decay = math.Min(1, b.decay+lb.WeightRecovery)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+/* ================= Request hooks ================= */
+
+// RequestInfo describes how the LB handled one request.
+type RequestInfo struct {
+	Pool     string        // pool that served it; "none" if rejected before routing
+	Backend  *Backend      // last backend attempted, nil if none was
+	Attempts int           // backends attempted, including retries
+	Sequence []string      // names of the backends attempted, in order
+	Status   int           // status sent to the client
+	Duration time.Duration // time spent in ServeHTTP
+	Tier     string        // QoS tier from the JWT claim; "" when JWT tiers are off
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of r carrying an empty RequestInfo that
+// ServeHTTP fills in. Middleware wrapping the LB reads it after ServeHTTP
+// returns:
+//
+//	r, info := WithRequestInfo(r)
+//	lb.ServeHTTP(w, r)
+//	if info.Backend != nil {
+//		log.Printf("%s served by %s", r.URL.Path, info.Backend.Name)
+//	}
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// RequestInfoFrom returns the RequestInfo attached by WithRequestInfo.
+func RequestInfoFrom(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// OnRequestDone registers fn to run after every request ServeHTTP handles,
+// once the response has been written. Hooks run synchronously on the
+// request goroutine and must be registered before serving starts.
+func (lb *LoadBalancer) OnRequestDone(fn func(r *http.Request, info RequestInfo)) {
+	lb.doneHooks = append(lb.doneHooks, fn)
+}
+
+func (lb *LoadBalancer) requestDone(r *http.Request, info RequestInfo) {
+	if dst, ok := RequestInfoFrom(r.Context()); ok {
+		*dst = info
+	}
+	for _, fn := range lb.doneHooks {
+		fn(r, info)
+	}
+}
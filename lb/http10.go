@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/* ================= HTTP/1.0 clients ================= */
+
+const (
+	// HTTP10Normalize (default) fills in a missing Host so Host and
+	// X-Forwarded-Host reach backends, which always get HTTP/1.1.
+	HTTP10Normalize = "normalize"
+	// HTTP10Pass proxies HTTP/1.0 requests as they are.
+	HTTP10Pass = "pass"
+	// HTTP10Reject answers 426 Upgrade Required.
+	HTTP10Reject = "reject"
+)
+
+func parseHTTP10Mode(v string) (string, error) {
+	switch v {
+	case HTTP10Normalize, HTTP10Pass, HTTP10Reject:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want %s, %s or %s)", v, HTTP10Normalize, HTTP10Pass, HTTP10Reject)
+}
+
+// handleHTTP10 applies HTTP10Mode to r, reporting false after writing a
+// rejection. A missing Host becomes HTTP10Host, else the address the
+// client connected to.
+func (lb *LoadBalancer) handleHTTP10(w http.ResponseWriter, r *http.Request) bool {
+	if r.ProtoAtLeast(1, 1) {
+		return true
+	}
+	switch lb.HTTP10Mode {
+	case HTTP10Reject:
+		w.Header().Set("Upgrade", "HTTP/1.1")
+		lb.writeError(w, r, http.StatusUpgradeRequired, reasonHTTP10, "HTTP/1.1 required")
+		return false
+	case HTTP10Normalize:
+		if r.Host != "" {
+			break
+		}
+		r.Host = lb.HTTP10Host
+		if r.Host == "" {
+			if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				r.Host = addr.String()
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* ================= JWT tiers ================= */
+
+// tierExtractor reads a QoS tier (or tenant) from a claim in the bearer
+// JWT. It is not authentication: with a Key, HS256 signatures are checked
+// so the claim cannot be forged, but the token is otherwise trusted.
+// Missing, malformed, expired or badly signed tokens get Default.
+type tierExtractor struct {
+	Claim   []string // path into the claims object, e.g. ["org", "tier"]
+	Key     []byte   // HS256 secret; nil skips signature checks
+	Default string
+}
+
+func newTierExtractor(claimPath, key, def string) *tierExtractor {
+	t := &tierExtractor{Claim: strings.Split(claimPath, "."), Default: def}
+	if key != "" {
+		t.Key = []byte(key)
+	}
+	return t
+}
+
+func (t *tierExtractor) tier(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return t.Default
+	}
+	claims, err := t.claims(strings.TrimSpace(token))
+	if err != nil {
+		return t.Default
+	}
+	var v any = claims
+	for _, k := range t.Claim {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return t.Default
+		}
+		v = m[k]
+	}
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case float64:
+		return fmt.Sprint(v)
+	}
+	return t.Default
+}
+
+// claims decodes token's payload, verifying the signature when t.Key is
+// set and rejecting tokens past their exp.
+func (t *tierExtractor) claims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT")
+	}
+	if t.Key != nil {
+		var hdr struct {
+			Alg string `json:"alg"`
+		}
+		if err := decodeSegment(parts[0], &hdr); err != nil || hdr.Alg != "HS256" {
+			return nil, fmt.Errorf("unsupported alg %q", hdr.Alg)
+		}
+		mac := hmac.New(sha256.New, t.Key)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("bad signature")
+		}
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() > int64(exp) {
+		return nil, fmt.Errorf("expired")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signJWT builds an HS256 token over claims with key.
+func signJWT(t *testing.T, key string, claims map[string]any) string {
+	t.Helper()
+	seg := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := seg(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + seg(claims)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func tierOf(tx *tierExtractor, token string) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return tx.tier(r)
+}
+
+func TestTierFromSignedJWT(t *testing.T) {
+	tx := newTierExtractor("org.tier", "secret", "free")
+	token := signJWT(t, "secret", map[string]any{"org": map[string]any{"tier": "pro"}})
+	if got := tierOf(tx, token); got != "pro" {
+		t.Errorf("tier %q, want pro", got)
+	}
+}
+
+func TestTierRejectsBadSignature(t *testing.T) {
+	tx := newTierExtractor("tier", "secret", "free")
+	forged := signJWT(t, "not-the-secret", map[string]any{"tier": "pro"})
+	if got := tierOf(tx, forged); got != "free" {
+		t.Errorf("forged token got tier %q, want the default", got)
+	}
+	tampered := signJWT(t, "secret", map[string]any{"tier": "pro"})
+	tampered = tampered[:len(tampered)-2] + "xx"
+	if got := tierOf(tx, tampered); got != "free" {
+		t.Errorf("tampered signature got tier %q, want the default", got)
+	}
+}
+
+func TestTierRejectsExpiredJWT(t *testing.T) {
+	tx := newTierExtractor("tier", "secret", "free")
+	expired := signJWT(t, "secret", map[string]any{"tier": "pro", "exp": time.Now().Add(-time.Minute).Unix()})
+	if got := tierOf(tx, expired); got != "free" {
+		t.Errorf("expired token got tier %q, want the default", got)
+	}
+	valid := signJWT(t, "secret", map[string]any{"tier": "pro", "exp": time.Now().Add(time.Minute).Unix()})
+	if got := tierOf(tx, valid); got != "pro" {
+		t.Errorf("unexpired token got tier %q, want pro", got)
+	}
+}
+
+func TestTierLimits(t *testing.T) {
+	h := newHarness(t, 1)
+	h.lb.tiers = newTierExtractor("tier", "secret", "free")
+	h.lb.tierLimits = newTenantLimiter("", map[string]rateLimit{"free": {RPS: 0.001, Burst: 1}}, rateLimit{}, time.Minute)
+	free := signJWT(t, "secret", map[string]any{"tier": "free"})
+	pro := signJWT(t, "secret", map[string]any{"tier": "pro"})
+
+	send := func(token string) int {
+		req, _ := http.NewRequest("GET", h.front.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := send(free); code != http.StatusOK {
+		t.Fatalf("first free request: status %d, want 200", code)
+	}
+	if code := send(free); code != http.StatusTooManyRequests {
+		t.Errorf("second free request: status %d, want 429", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := send(pro); code != http.StatusOK {
+			t.Errorf("pro request %d: status %d, want 200 (no tier limit)", i, code)
+		}
+	}
+}
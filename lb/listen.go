@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Listener ================= */
+
+var lbShedConnsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{Name: "lb_shed_connections_total", Help: "Connections refused at accept because in-flight requests reached CONN_HIGH_WATER"},
+)
+
+func init() { prometheus.MustRegister(lbShedConnsTotal) }
+
+// listen opens the main TCP listener. backlog (accept queue length) and
+// rcvbuf (SO_RCVBUF, inherited by accepted sockets) are applied when
+// positive; zero keeps the OS defaults.
+func listen(addr string, backlog, rcvbuf int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if backlog > 0 || rcvbuf > 0 {
+		if err := tuneListener(ln.(*net.TCPListener), backlog, rcvbuf); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// shedResponse is written straight to the socket, before any request has
+// been read, so it must be a complete HTTP/1.1 response.
+const shedResponse = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Retry-After: 1\r\nConnection: close\r\nContent-Length: 12\r\n\r\n" +
+	"overloaded\r\n"
+
+// shedListener refuses new connections while the LB has at least
+// ConnHighWater requests in flight, so overload shows up as an immediate
+// 503 rather than connections queuing until clients time out. Plain HTTP
+// connections get shedResponse; TLS ones (plain == false) are just closed
+// since nothing can be said before the handshake.
+type shedListener struct {
+	net.Listener
+	lb    *LoadBalancer
+	plain bool
+}
+
+func (l *shedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.lb.inFlight.Load() < l.lb.ConnHighWater {
+			return c, err
+		}
+		lbShedConnsTotal.Inc()
+		if l.plain {
+			go shed(c)
+		} else {
+			c.Close()
+		}
+	}
+}
+
+// shedDrainBytes caps how much of a shed client's request is read.
+const shedDrainBytes = 64 << 10
+
+// shed writes shedResponse to c and closes it gracefully: the write side
+// first, then after draining what the client sent. Closing with unread
+// data would make the kernel send RST, which most clients report as a
+// reset connection instead of the 503. The whole exchange gets a second.
+func shed(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(c, shedResponse); err != nil {
+		return
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(c, shedDrainBytes))
+}
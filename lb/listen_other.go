@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// tuneListener is a no-op where listen(2) cannot be re-issued.
+func tuneListener(ln *net.TCPListener, backlog, rcvbuf int) error {
+	log.Printf("[LB] LISTEN_BACKLOG/LISTEN_RCVBUF not supported on this platform; using defaults")
+	return nil
+}
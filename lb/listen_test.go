@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShedListenerAnswers503AboveHighWater(t *testing.T) {
+	lb := NewLoadBalancer(nil)
+	lb.ConnHighWater = 1
+	lb.inFlight.Store(1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: lb}
+	go srv.Serve(&shedListener{Listener: ln, lb: lb, plain: true})
+	defer srv.Close()
+
+	// The body follows after the LB has answered, as it does for a client
+	// still uploading; the response must survive it.
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: lb\r\nContent-Length: 5\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(c, "hello")
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("shed connection failed instead of answering 503: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("got %d Retry-After=%q, want 503 with Retry-After 1", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if string(got) != "overloaded\r\n" {
+		t.Errorf("body %q", got)
+	}
+}
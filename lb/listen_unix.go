@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// tuneListener re-issues listen(2) with the requested backlog, which the
+// kernel applies to an already-listening socket, and sets SO_RCVBUF.
+func tuneListener(ln *net.TCPListener, backlog, rcvbuf int) error {
+	raw, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if rcvbuf > 0 {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); serr != nil {
+				return
+			}
+		}
+		if backlog > 0 {
+			serr = syscall.Listen(int(fd), backlog)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
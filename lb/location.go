@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* ================= Redirect rewriting ================= */
+
+// rewriteLocation maps an absolute Location pointing at an internal host
+// back to an external one, so redirects do not leak backend addresses.
+// Hosts in LocationMap go to their configured target; the backend's own
+// host goes to the scheme and host the client used, taken from the
+// request itself rather than forwarded headers a client could set.
+// Relative Locations, foreign hosts and requests without a Host are left
+// alone.
+func (lb *LoadBalancer) rewriteLocation(b *Backend, resp *http.Response) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || !u.IsAbs() {
+		return
+	}
+	if to, ok := lb.LocationMap[strings.ToLower(u.Host)]; ok {
+		if to.Scheme != "" {
+			u.Scheme = to.Scheme
+		}
+		u.Host = to.Host
+	} else if sameHost(u, b.target) && resp.Request != nil {
+		st, ok := resp.Request.Context().Value(attemptKey{}).(*attemptResult)
+		if !ok || st.host == "" {
+			return
+		}
+		u.Scheme, u.Host = st.scheme, st.host
+	} else {
+		return
+	}
+	resp.Header.Set("Location", u.String())
+}
+
+// sameHost compares the hosts of a and b with default ports made
+// explicit, so http://backend and http://backend:80 match.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(hostPort(a), hostPort(b))
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if strings.EqualFold(u.Scheme, "https") {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// parseLocationMap parses LOCATION_MAP: comma-separated "internal=external"
+// pairs where external is a host or scheme://host.
+func parseLocationMap(v string) (map[string]*url.URL, error) {
+	m := map[string]*url.URL{}
+	for _, pair := range splitList(v) {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return nil, fmt.Errorf("invalid mapping %q: want internal=external", pair)
+		}
+		to = strings.TrimSpace(to)
+		if !strings.Contains(to, "://") {
+			to = "//" + to
+		}
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid mapping target in %q", pair)
+		}
+		m[strings.ToLower(strings.TrimSpace(from))] = u
+	}
+	return m, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// locationAfter runs rewriteLocation on a backend response carrying loc,
+// for a client request that addressed host over scheme.
+func locationAfter(lb *LoadBalancer, loc, host, scheme string) string {
+	st := &attemptResult{host: host, scheme: scheme}
+	req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), attemptKey{}, st), http.MethodGet, "http://backend/", nil)
+	// forwarded headers are client-controlled under FORWARDED_POLICY=keep
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp := &http.Response{Header: http.Header{"Location": {loc}}, Request: req}
+	lb.rewriteLocation(lb.Backends[0], resp)
+	return resp.Header.Get("Location")
+}
+
+func TestRewriteLocation(t *testing.T) {
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://backend:80"}})
+	m, err := parseLocationMap("auth.internal=https://login.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.LocationMap = m
+	for _, tc := range []struct {
+		loc, host, want string
+	}{
+		{"http://backend:80/a?b=1", "shop.example", "http://shop.example/a?b=1"},
+		{"http://backend/a", "shop.example", "http://shop.example/a"},
+		{"http://BACKEND:80/a", "shop.example:8080", "http://shop.example:8080/a"},
+		{"http://backend:8080/a", "shop.example", "http://backend:8080/a"},
+		{"http://backend/a", "", "http://backend/a"},
+		{"http://auth.internal/login", "shop.example", "https://login.example/login"},
+		{"https://other.example/a", "shop.example", "https://other.example/a"},
+		{"/relative", "shop.example", "/relative"},
+	} {
+		if got := locationAfter(lb, tc.loc, tc.host, "http"); got != tc.want {
+			t.Errorf("Location %q for Host %q: got %q, want %q", tc.loc, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteLocationUsesClientScheme(t *testing.T) {
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://backend:80"}})
+	if got, want := locationAfter(lb, "http://backend/a", "shop.example", "https"), "https://shop.example/a"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
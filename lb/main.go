@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,171 +32,1557 @@ import (
 var (
 	lbRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "lb_requests_total", Help: "LB total handled requests"},
-		[]string{"code", "method"},
+		[]string{"route", "code", "method"},
 	)
 	lbAttemptsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "lb_backend_attempts_total", Help: "Attempts per backend"},
-		[]string{"backend"},
+		[]string{"route", "backend"},
 	)
 	lbFailuresTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{Name: "lb_backend_failures_total", Help: "Failures per backend"},
-		[]string{"backend", "reason"},
+		[]string{"route", "backend", "reason"},
 	)
-	lbLatencySeconds = prometheus.NewHistogram(
+	lbLatencySeconds = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{Name: "lb_request_duration_seconds", Help: "LB end-to-end latency", Buckets: prometheus.DefBuckets},
+		[]string{"route"},
+	)
+	lbRetriesExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_retries_exhausted_total", Help: "Requests that ran out of distinct alive backends to retry on"},
+		[]string{"route"},
+	)
+	lbResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "lb_response_bytes", Help: "Response body bytes sent to clients", Buckets: prometheus.ExponentialBuckets(256, 4, 8)},
+		[]string{"route"},
+	)
+	lbActiveConns = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "lb_backend_active_connections", Help: "In-flight proxied requests per backend"},
+		[]string{"backend"},
+	)
+	lbDeniedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_denied_requests_total", Help: "Requests rejected by the path deny-list"},
+		[]string{"rule"},
+	)
+	lbSLOViolationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "lb_slo_violations_total", Help: "Requests slower than SLO_THRESHOLD"},
+	)
+	lbSlowRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_slow_requests_total", Help: "Requests slower than SLOW_REQUEST_THRESHOLD"},
+		[]string{"route"},
+	)
+	lbSLOViolationRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "lb_slo_violation_ratio", Help: "Fraction of requests slower than SLO_THRESHOLD since start"},
+	)
+	lbBreakerOpensTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_breaker_opens_total", Help: "Times a backend's breaker opened"},
+		[]string{"backend"},
+	)
+	lbBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "lb_breaker_state", Help: "Breaker state per backend (0=closed, 1=open, 2=half-open)"},
+		[]string{"backend"},
+	)
+	lbBreakerOpenSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "lb_breaker_open_seconds", Help: "Duration of the backend's most recent open period"},
+		[]string{"backend"},
+	)
+	lbPoolOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "lb_pool_open", Help: "1 while every backend in the pool is down and requests are shed"},
+		[]string{"pool"},
+	)
+	lbStaleServedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "lb_stale_served_total", Help: "Stale cached responses served during outages"},
+	)
+	lbHealthChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_health_checks_total", Help: "Health probes per backend by result"},
+		[]string{"backend", "result"},
+	)
+	lbBackendDownSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "lb_backend_down_duration_seconds", Help: "How long a currently-down backend has been down (0 while up)"},
+		[]string{"backend"},
+	)
+	lbHealthCheckSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "lb_health_check_duration_seconds", Help: "Health probe latency", Buckets: prometheus.DefBuckets},
+		[]string{"backend"},
+	)
+	// TTFB and transfer split lb_request_duration_seconds into the backend's
+	// think time and the time spent copying the response to the client.
+	lbBackendTTFBSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "lb_backend_ttfb_seconds", Help: "Attempt start to first response byte from the backend", Buckets: prometheus.DefBuckets},
+		[]string{"backend"},
+	)
+	lbTransferSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "lb_response_transfer_seconds", Help: "First response byte to the end of the copy to the client (streams excluded)", Buckets: prometheus.DefBuckets},
+		[]string{"route"},
+	)
+	lbOversizedHeaders = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "lb_oversized_response_headers_total", Help: "Backend responses rejected for headers over MAX_RESPONSE_HEADER_BYTES"},
+		[]string{"backend"},
+	)
+	// Selection runs in microseconds for the simple strategies, so the
+	// buckets start at 1µs rather than DefBuckets' 5ms.
+	lbSelectionSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{Name: "lb_selection_duration_seconds", Help: "Time spent picking a backend", Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10)},
+		[]string{"strategy"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(lbRequestsTotal, lbAttemptsTotal, lbFailuresTotal, lbLatencySeconds)
+	prometheus.MustRegister(lbRequestsTotal, lbAttemptsTotal, lbFailuresTotal, lbLatencySeconds, lbResponseBytes,
+		lbRetriesExhaustedTotal, lbActiveConns, lbDeniedTotal, lbSLOViolationsTotal, lbSLOViolationRatio, lbSlowRequestsTotal,
+		lbBreakerOpensTotal, lbBreakerState, lbBreakerOpenSeconds, lbPoolOpen, lbStaleServedTotal,
+		lbHealthChecksTotal, lbHealthCheckSeconds, lbBackendDownSeconds, lbSelectionSeconds,
+		lbBackendTTFBSeconds, lbTransferSeconds, lbOversizedHeaders)
 }
 
 /* ================= Model ================= */
 
 type Backend struct {
+	// URL is the backend as configured; target is what requests address,
+	// which differs for a Unix socket backend (see socket).
 	URL            *url.URL
+	target         *url.URL
+	socket         string
 	Alive          bool
 	ConsecFailures int
 	mu             sync.RWMutex
 	ReverseProxy   *httputil.ReverseProxy
 	Name           string
+	Weight         int
+	Zone           string
+	Tier           string
+
+	// LastStateChange is when Alive last flipped (or the backend was added).
+	LastStateChange time.Time
+
+	// preserveHost overrides LoadBalancer.PreserveHost when set.
+	preserveHost *bool
+	// reqTimeout overrides LoadBalancer.ReqTimeout when non-zero.
+	reqTimeout time.Duration
+	// headers are set on every request sent to this backend.
+	headers http.Header
+
+	transport *http.Transport
+	conns     connStats
+	// probeTransport serves health probes: no keep-alive, so every probe
+	// dials, and none of the proxy pool's aging or connection counts.
+	probeTransport *http.Transport
+
+	// active counts in-flight proxied requests; draining excludes the
+	// backend from selection while it is being removed.
+	active   atomic.Int64
+	draining atomic.Bool
+
+	// shutdownAt (unix nanos, 0 = no) is when b reported shutting down;
+	// see noteShutdown.
+	shutdownAt atomic.Int64
+
+	// coolUntil (unix nanos) keeps b out of selection after it answered
+	// with Retry-After; see noteRetryAfter.
+	coolUntil atomic.Int64
+
+	// windowAttempts counts attempts since the last fairness window closed.
+	windowAttempts atomic.Int64
+
+	breaker  breakerState // guarded by mu
+	openedAt time.Time
+
+	// adaptive health-check scheduling, guarded by mu
+	nextCheck time.Time
+	suspect   bool
+	okStreak  int
+	// probing is set while a scheduled probe is running, so a slow
+	// backend never has two in flight.
+	probing atomic.Bool
+	// deepProbing and pinging do the same for the deep check and the
+	// keepalive pings.
+	deepProbing atomic.Bool
+	pinging     atomic.Bool
+
+	// riseStreak counts consecutive passing probes while down, toward
+	// HealthRiseThreshold; guarded by mu
+	riseStreak int
+
+	// failed-probe log throttling, guarded by mu; see logUnhealthy
+	downLoggedAt   time.Time
+	downSuppressed int
+
+	// health score inputs (EWMAs) and result, guarded by mu
+	probeSuccess float64
+	probeLatency float64
+	score        float64
+	load         float64 // smoothed utilization from LoadHeader
+	decay        float64 // failure-driven weight factor; see decayWeight
+	deep         float64 // 1, or DeepHealthWeight while the deep check fails
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// setBreaker records a breaker transition; caller holds b.mu.
+func (b *Backend) setBreaker(st breakerState) {
+	b.breaker = st
+	lbBreakerState.WithLabelValues(b.Name).Set(float64(st))
 }
 
 func (b *Backend) SetAlive(alive bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.Alive = alive
+	b.setAliveLocked(alive)
 	if alive {
 		b.ConsecFailures = 0
+	} else {
+		b.riseStreak = 0
+	}
+}
+
+// setAliveLocked sets Alive, stamping LastStateChange when it flips.
+// b.mu must be held.
+func (b *Backend) setAliveLocked(alive bool) {
+	if b.Alive != alive {
+		b.LastStateChange = time.Now()
+		if alive {
+			b.downLoggedAt = time.Time{} // the next outage logs at once
+		} else {
+			b.resetDeep() // the deep check judges it afresh after recovery
+		}
+	}
+	b.Alive = alive
+}
+
+// downFor is how long b has been down as of now, or 0 if it is alive.
+func (b *Backend) downFor(now time.Time) time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.Alive {
+		return 0
+	}
+	return now.Sub(b.LastStateChange)
+}
+
+func (b *Backend) lastStateChange() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.LastStateChange
+}
+
+// rise records a successful probe and reports whether b may be marked
+// alive: immediately if it already is, otherwise once threshold
+// consecutive probes have passed. streak is the count so far.
+func (b *Backend) rise(threshold int) (ready bool, streak int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Alive {
+		b.riseStreak = 0
+		return true, 0
 	}
+	b.riseStreak++
+	if b.riseStreak < threshold {
+		return false, b.riseStreak
+	}
+	b.riseStreak = 0
+	return true, threshold
 }
 
 func (b *Backend) IsAlive() bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return b.Alive
+	return b.Alive && !b.draining.Load() && b.shutdownAt.Load() == 0
 }
 
-type LoadBalancer struct {
+// Pool is a named group of backends with its own round-robin cursor.
+type Pool struct {
+	Name     string
 	Backends []*Backend
 	mu       sync.Mutex
 	current  int
+	cw       []int // smooth-WRR current weights, parallel to Backends
+	ring     *hashRing
+
+	// open is set while every backend in the pool is down; see failFast.
+	open      atomic.Bool
+	lastProbe atomic.Int64 // unix nanos of the last request let through while open
+
+	// degraded is set while fewer than MinHealthyFraction of the
+	// backends are alive; see updateDegraded.
+	degraded atomic.Bool
+}
+
+func (p *Pool) setOpen(open bool) {
+	if p.open.Swap(open) == open {
+		return
+	}
+	log.Printf("[pool] %s open=%t", p.Name, open)
+	v := 0.0
+	if open {
+		v = 1
+	}
+	lbPoolOpen.WithLabelValues(p.Name).Set(v)
+}
+
+// allowProbe lets one request through per interval while the pool is open.
+func (p *Pool) allowProbe(interval time.Duration) bool {
+	now := time.Now().UnixNano()
+	last := p.lastProbe.Load()
+	return now-last >= int64(interval) && p.lastProbe.CompareAndSwap(last, now)
+}
+
+// members returns a snapshot of the pool's backends.
+func (p *Pool) members() []*Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Backend(nil), p.Backends...)
+}
+
+func (p *Pool) contains(b *Backend) bool {
+	for _, x := range p.members() {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckGRPC = "grpc"
+)
+
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyPathHash           = "path_hash"
+	StrategyClientHash         = "client_hash"
+	StrategyLeastConn          = "least_conn"
+	StrategyAdaptive           = "adaptive"
+)
+
+type LoadBalancer struct {
+	// Backends holds every backend across all pools; it drives health checks.
+	Backends []*Backend
+	Strategy string
+	// HashFallbackDepth bounds how many backends the hash strategies walk
+	// round the ring from a key's owner before giving up (0 = all).
+	HashFallbackDepth int
+
+	// pool is the active pool that normal traffic is drawn from; pools holds
+	// every named pool (e.g. "default", or "blue"/"green") in config order.
+	mu    sync.RWMutex
+	pool  *Pool
+	pools []*Pool
 
 	HealthPath      string
+	HealthCheckType string // "http" (default) or "grpc"
+	GRPCService     string // service name sent in grpc.health.v1 Check
 	HealthInterval  time.Duration
 	HealthTimeout   time.Duration
 	MaxConsecFail   int
 	BreakerCooldown time.Duration
-	ReqTimeout      time.Duration
-	MaxRetries      int
+	// TLSErrorTripsBreaker opens a backend's breaker on its first
+	// certificate error instead of after MaxConsecFail.
+	TLSErrorTripsBreaker bool
+
+	ReqTimeout time.Duration
+	// RetryAfter is advertised on 503s sent when no backend is alive.
+	RetryAfter time.Duration
+	// BackendRetryAfterMax caps how long a backend that answered 503/429
+	// with Retry-After is left out of selection (0 = ignore the header).
+	BackendRetryAfterMax time.Duration
+	// TotalTimeout caps a whole request including retries (0 = no cap).
+	// Each attempt gets min(ReqTimeout, time left); once it is spent the
+	// client receives 504.
+	TotalTimeout time.Duration
+	MaxRetries   int
+	// MaxRetriesCap bounds per-request overrides sent in X-LB-Max-Retries.
+	MaxRetriesCap int
+	// RetryAllBackends makes idempotent requests try every alive backend in
+	// the pool before giving up, regardless of MaxRetries.
+	RetryAllBackends bool
+	// RetryPreferHealthy sends retries to the healthiest untried backend
+	// (see nextHealthiest) rather than the strategy's next pick.
+	RetryPreferHealthy bool
+
+	// IPSources is the order in which the client IP is looked up
+	// ("x-forwarded-for", "x-real-ip", "remote"). Forwarded headers are only
+	// honored when the direct peer is in TrustedProxies.
+	IPSources      []string
+	TrustedProxies []*net.IPNet
+
+	// Requests whose body exceeds UploadThreshold go to UploadPool (when
+	// set); bodies over MaxBodyBytes are rejected with 413. Zero disables.
+	UploadPool      *Pool
+	UploadThreshold int64
+	MaxBodyBytes    int64
+
+	// MirrorPool, when set, gets asynchronous copies of MirrorPercent
+	// (0-100) of requests; see mirror.
+	MirrorPool        *Pool
+	MirrorPercent     float64
+	MirrorTimeout     time.Duration
+	MirrorMaxInFlight int
+	mirrorSlots       chan struct{}
+	// RetryBodyBytes is the largest body buffered so that retries can
+	// resend it; larger or chunked bodies are sent once without retries.
+	RetryBodyBytes int64
+	// ExpectContinue is ExpectForward (default) or ExpectLocal.
+	ExpectContinue string
+	// ResponseMode is ResponseStream (default) or ResponseBuffer, which
+	// holds responses up to ResponseBufferBytes so mid-body failures retry.
+	ResponseMode        string
+	ResponseBufferBytes int64
+
+	// DenyPaths are rejected with 403 by denyPaths, in front of every
+	// route on the client listener.
+	DenyPaths []pathRule
+	// AllowedMethods, when non-empty, is the only set of request methods
+	// proxied; anything else is answered 405 with an Allow header.
+	AllowedMethods []string
+
+	// DeadLetterURL, when set, receives a JSON description of every request
+	// that exhausted its retries; at most DeadLetterMaxBody body bytes are kept.
+	DeadLetterURL     string
+	DeadLetterMaxBody int
+
+	// WarmupConns idle connections are pre-opened to each backend at startup
+	// and whenever it recovers. Zero disables warmup.
+	WarmupConns int
+	// MaxResponseHeaderBytes caps a backend's response headers; a response
+	// over it fails the attempt (and is retried) instead of being read
+	// into memory. Set it with SetMaxResponseHeaderBytes once backends exist.
+	MaxResponseHeaderBytes int64
+	// KeepaliveInterval, when set, pings backends with HEAD on that
+	// period to keep idle connections open; see StartKeepalive.
+	KeepaliveInterval time.Duration
+
+	// PoolFailFast answers 503 immediately while every backend in a pool is
+	// down, letting one probe request through per PoolProbeInterval.
+	PoolFailFast      bool
+	PoolProbeInterval time.Duration
+
+	// MinHealthyFraction marks a pool degraded (lb_pool_degraded) when
+	// its alive share drops below it (0 = off); while degraded, requests
+	// matching DegradedShedPaths are shed with 503.
+	MinHealthyFraction float64
+	DegradedShedPaths  []pathRule
+
+	// Backend dialing: DialMode is "dual" (Happy Eyeballs, racing the
+	// second address family after DialFallbackDelay), "ipv4" or "ipv6".
+	DialMode          string
+	DialTimeout       time.Duration
+	DialFallbackDelay time.Duration
+	// MaxConnAge retires idle backend connections older than this, so
+	// sockets silently dropped by NAT are not hit (0 = off).
+	MaxConnAge time.Duration
+
+	// ResponseSizeMetrics records lb_response_bytes per request.
+	ResponseSizeMetrics bool
+
+	// doneHooks run after each request; see OnRequestDone.
+	doneHooks []func(r *http.Request, info RequestInfo)
+
+	// stale, when set (SERVE_STALE), keeps GET responses marked
+	// stale-if-error and serves them when no backend is alive.
+	stale *staleCache
+
+	// tenants, when set (TENANT_LIMITS / TENANT_DEFAULT_LIMIT), rate-limits
+	// requests per tenant header value.
+	tenants *tenantLimiter
+
+	// tiers, when set (JWT_TIER_CLAIM), assigns each request a QoS tier
+	// from its bearer token; see tierExtractor.
+	tiers *tierExtractor
+	// tierLimits, when set (TIER_LIMITS), rate-limits requests per tier,
+	// one bucket per tier shared by every client in it.
+	tierLimits *tenantLimiter
+
+	// sessions, when set (SESSION_COOKIE / SESSION_HINT_HEADER), pins
+	// backend-issued session ids to the backend that issued them.
+	sessions *sessionAffinity
+
+	// AdminToken guards every admin endpoint and operator-only request
+	// headers such as X-LB-Backend. Empty disables both.
+	AdminToken string
+
+	// GroupStatusCodes labels lb_requests_total by status class (2xx, 5xx)
+	// instead of the exact code.
+	GroupStatusCodes bool
+
+	// HealthRiseThreshold is how many consecutive passing probes a down
+	// backend needs before it is marked alive again, to stop flapping.
+	// The fall side stays MaxConsecFail for request failures.
+	HealthRiseThreshold int
+
+	// DeepHealthPath is probed every DeepHealthInterval alongside the
+	// normal check, with its own DeepHealthTimeout since deep endpoints
+	// are slow by design. A failure does not eject the backend; it scales
+	// its effective weight by DeepHealthWeight until the deep check
+	// passes, so it only shifts traffic under weighted_round_robin.
+	DeepHealthPath     string
+	DeepHealthInterval time.Duration
+	DeepHealthTimeout  time.Duration
+	DeepHealthWeight   float64
+
+	// HealthLogInterval throttles "unhealthy" lines for a backend that
+	// stays down to one per interval (0 = one per failed probe).
+	HealthLogInterval time.Duration
+
+	// HealthWeighting scales each backend's weight by a score derived from
+	// recent probe success and latency (see scoreProbe), so slow backends
+	// get proportionally less traffic under weighted round-robin.
+	HealthWeighting     bool
+	HealthLatencyTarget time.Duration
+	HealthScoreFloor    float64
+	// WeightDecay (0-1, 0 = off) multiplies a backend's effective weight on
+	// every request failure, down to WeightDecayFloor; each success adds
+	// WeightRecovery back, up to 1. A soft ejection short of the breaker.
+	WeightDecay      float64
+	WeightDecayFloor float64
+	WeightRecovery   float64
+	// LoadHeader names a response header (e.g. X-Load) in which backends
+	// report utilization from 0 to 1; when set, weights shrink with load.
+	LoadHeader string
+
+	// ForwardedPort and ForwardedServer (the LB's hostname; empty = off)
+	// add X-Forwarded-Port and X-Forwarded-Server to proxied requests.
+	ForwardedPort   bool
+	ForwardedServer string
+
+	// RewriteLocation maps redirects to internal hosts back to external
+	// ones: LocationMap entries (internal host -> external URL) and the
+	// backend's own host, which becomes the host the client used.
+	RewriteLocation bool
+	LocationMap     map[string]*url.URL
+
+	// ForwardTrailers relays backend HTTP trailers (e.g. grpc-status) to
+	// the client, both declared ones and those added after the body. They
+	// need a chunked response, so HTTP/1.0 clients never see them, and
+	// responses replayed from the stale cache carry none.
+	ForwardTrailers bool
+
+	// PreserveHost forwards the client's Host header to backends (the
+	// default); when false the Host is rewritten to the backend's own host.
+	// Backends can override it with preserve_host in BACKENDS_JSON.
+	PreserveHost bool
+
+	// CORS, when set, answers preflights at the LB and adds CORS headers
+	// to proxied responses; see CORSPolicy.
+	CORS *CORSPolicy
+
+	// ErrorHeaders are added to every error the LB answers itself (not
+	// backend errors), alongside X-LB-Error-Reason. ErrorFormat is
+	// ErrorFormatText (default) or ErrorFormatJSON, whose body carries the
+	// request ID read from RequestIDHeader.
+	ErrorHeaders    http.Header
+	ErrorFormat     string
+	RequestIDHeader string
+	// ErrorPages replaces the body of LB errors with a static page per
+	// status code (e.g. a branded 502, a 503 maintenance page).
+	ErrorPages map[int]errorPage
+
+	// ShutdownHeader (e.g. X-Shutting-Down) lets a backend announce a
+	// graceful shutdown on any response, as can Connection: close when
+	// DrainOnConnClose is set; it then gets no new requests until a probe
+	// passes ShutdownHold later.
+	ShutdownHeader   string
+	DrainOnConnClose bool
+	ShutdownHold     time.Duration
+
+	// ForwardedPolicy decides whether client-supplied forwarding headers
+	// (Forwarded, X-Forwarded-Host, X-Real-IP, ...) reach backends:
+	// ForwardedTrusted, ForwardedStrip or ForwardedKeep.
+	ForwardedPolicy string
+
+	// HTTP10Mode is how HTTP/1.0 requests are treated: HTTP10Normalize,
+	// HTTP10Pass or HTTP10Reject. HTTP10Host replaces a missing Host.
+	HTTP10Mode string
+	HTTP10Host string
+
+	// AttemptTrace is a debugging aid: each response gets X-LB-Trace
+	// listing the backends attempted in order, and a [trace] line is
+	// logged per request. It exposes topology, so keep it off normally.
+	AttemptTrace bool
+
+	// TraceMatch selects requests (by header or client IP) whose whole
+	// lifecycle, with headers, is written as one JSON line to traceLog
+	// (TRACE_LOG, else the main log). Other requests are unaffected.
+	// TraceRedact (on by default) masks redactedHeaders in those lines;
+	// turn it off only when the trace log is as protected as the traffic.
+	TraceMatch  []traceRule
+	TraceRedact bool
+	traceLog    *log.Logger
+
+	// ExposeBackend adds an X-Backend response header naming the backend
+	// that served the request. Off by default to avoid leaking topology.
+	ExposeBackend bool
+
+	// MaskUpstreamErrors replaces a 5xx from the final backend attempt with
+	// the LB's own generic error of the same status, so backend error
+	// bodies and headers never reach the client. Off by default: the last
+	// backend's response passes through verbatim.
+	MaskUpstreamErrors bool
+
+	// StatusRules overrides, per status code, whether a response triggers a
+	// retry and in which pool (e.g. 429 to an overflow pool). Unlisted 5xx
+	// retry in the same pool; see statusAction.
+	StatusRules map[int]statusRule
+
+	// ConnectAllow turns on forward-proxy mode: CONNECT requests to these
+	// destinations are tunneled instead of balanced. Empty (the default)
+	// leaves CONNECT to the reverse proxy like any other method.
+	ConnectAllow []connectRule
+
+	// SLOThreshold is the latency above which a request counts against the
+	// SLO; zero disables tracking. sloMu guards the two counts so the
+	// ratio is always computed from a consistent pair.
+	SLOThreshold  time.Duration
+	sloMu         sync.Mutex
+	sloTotal      int64
+	sloViolations int64
+
+	// SlowThreshold logs a [slow] WARN line for each request taking
+	// longer; zero disables it.
+	SlowThreshold time.Duration
+
+	// ConnHighWater sheds new client connections at accept time while
+	// this many requests are in flight (0 = never).
+	ConnHighWater int64
+	inFlight      atomic.Int64
+
+	// StrategyAdaptive delegates to AdaptiveLow until AdaptiveHighWater
+	// requests are in flight, then to AdaptiveHigh until they drop back to
+	// AdaptiveLowWater; see adaptiveStrategy.
+	AdaptiveLow       string
+	AdaptiveHigh      string
+	AdaptiveLowWater  int64
+	AdaptiveHighWater int64
+	adaptiveHigh      atomic.Bool
+
+	// FairnessWindow is how often observed traffic shares are compared
+	// with configured weights (lb_backend_share_drift, /admin/fairness);
+	// zero disables it.
+	FairnessWindow time.Duration
+	fairness       atomic.Pointer[fairnessReport]
+
+	// summarySamples are the counter sums seen by recent status page
+	// renders, the baseline for its windowed columns; see recentSums.
+	summaryMu      sync.Mutex
+	summarySamples []summarySample
 }
 
-func NewLoadBalancer(targets []string) *LoadBalancer {
-	backends := make([]*Backend, 0, len(targets))
-	for _, t := range targets {
-		u, err := url.Parse(t)
-		if err != nil {
-			log.Fatalf("invalid backend url %q: %v", t, err)
-		}
-		proxy := httputil.NewSingleHostReverseProxy(u)
-		proxy.Transport = &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			DialContext:           (&net.Dialer{Timeout: 2 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          200,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   2 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}
-		b := &Backend{URL: u, Alive: true, ReverseProxy: proxy, Name: u.Host}
-		backends = append(backends, b)
-	}
-	return &LoadBalancer{
-		Backends:        backends,
-		HealthPath:      "/health",
-		HealthInterval:  2 * time.Second,
-		HealthTimeout:   1 * time.Second,
-		MaxConsecFail:   3,
-		BreakerCooldown: 10 * time.Second,
-		ReqTimeout:      1500 * time.Millisecond,
-		MaxRetries:      2,
-	}
-}
-
-func (lb *LoadBalancer) nextAliveBackend() (*Backend, int, error) {
+func (lb *LoadBalancer) newBackend(u *url.URL, cfg BackendConfig) *Backend {
+	// HTTP to a Unix socket goes to a placeholder host; dialFor connects
+	// every connection to the socket instead.
+	target, name, socket := u, u.Host, ""
+	if u.Scheme == "unix" {
+		target, name, socket = &url.URL{Scheme: "http", Host: "localhost"}, "unix:"+u.Path, u.Path
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          200,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     cfg.DisableKeepAlive,
+	}
+	proxy.Transport = transport
+	proxy.ErrorHandler = lb.proxyErrorHandler
+	b := &Backend{
+		URL: u, target: target, socket: socket, Alive: true, LastStateChange: time.Now(), ReverseProxy: proxy, Name: name, transport: transport,
+		Weight: cfg.weight(), Zone: cfg.Zone, Tier: cfg.Tier, preserveHost: cfg.PreserveHost,
+		reqTimeout: cfg.reqTimeout(), probeSuccess: 1, score: 1, decay: 1, deep: 1,
+		headers: cfg.header(),
+	}
+	transport.DialContext = lb.dialFor(b)
+	transport.MaxResponseHeaderBytes = lb.MaxResponseHeaderBytes
+	b.probeTransport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 2 * time.Second,
+		DisableKeepAlives:   true,
+		DialContext:         lb.probeDialFor(b),
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if !lb.preservesHost(b) {
+			req.Host = target.Host
+		}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error { return lb.modifyResponse(b, resp) }
+	return b
+}
+
+func (lb *LoadBalancer) preservesHost(b *Backend) bool {
+	if b.preserveHost != nil {
+		return *b.preserveHost
+	}
+	return lb.PreserveHost
+}
+
+// reqTimeoutFor is the per-attempt timeout for b: its own req_timeout
+// when configured, else the global ReqTimeout.
+func (lb *LoadBalancer) reqTimeoutFor(b *Backend) time.Duration {
+	if b.reqTimeout > 0 {
+		return b.reqTimeout
+	}
+	return lb.ReqTimeout
+}
+
+// newBackends validates and builds a list of backends. A non-empty list
+// whose weights are all zero is rejected since it would route nowhere.
+func (lb *LoadBalancer) newBackends(cfgs []BackendConfig) []*Backend {
+	if err := validateBackends(cfgs); err != nil {
+		log.Fatal(err)
+	}
+	backends := make([]*Backend, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		u, _ := cfg.parseURL()
+		backends = append(backends, lb.newBackend(u, cfg))
+	}
+	return backends
+}
+
+func NewLoadBalancer(targets []BackendConfig) *LoadBalancer {
+	lb := &LoadBalancer{
+		Strategy:          StrategyRoundRobin,
+		HealthPath:        "/health",
+		HealthCheckType:   HealthCheckHTTP,
+		HealthInterval:    2 * time.Second,
+		HealthTimeout:     1 * time.Second,
+		MaxConsecFail:     3,
+		BreakerCooldown:   10 * time.Second,
+		ReqTimeout:        1500 * time.Millisecond,
+		MaxRetries:        2,
+		RetryAfter:        2 * time.Second,
+		MaxRetriesCap:     5,
+		PoolProbeInterval: 1 * time.Second,
+		DialMode:          DialDualStack,
+		DialTimeout:       2 * time.Second,
+		DialFallbackDelay: 300 * time.Millisecond,
+		IPSources:         []string{"remote"},
+		PreserveHost:      true,
+		ForwardTrailers:   true,
+		RetryBodyBytes:    1 << 20,
+		ExpectContinue:    ExpectForward,
+		ResponseMode:      ResponseStream,
+
+		ResponseBufferBytes: 1 << 20,
+		HealthRiseThreshold: 1,
+		HealthLatencyTarget: 100 * time.Millisecond,
+		HealthScoreFloor:    0.05,
+		WeightDecayFloor:    0.05,
+		WeightRecovery:      0.1,
+
+		BackendRetryAfterMax: 30 * time.Second,
+		ErrorFormat:          ErrorFormatText,
+		ShutdownHeader:       "X-Shutting-Down",
+		ShutdownHold:         30 * time.Second,
+		HTTP10Mode:           HTTP10Normalize,
+		FairnessWindow:       time.Minute,
+		HealthLogInterval:    time.Minute,
+		AdaptiveLow:          StrategyRoundRobin,
+		AdaptiveHigh:         StrategyLeastConn,
+		AdaptiveLowWater:     50,
+		AdaptiveHighWater:    100,
+		ForwardedPolicy:      ForwardedTrusted,
+		RequestIDHeader:      DefaultCorrelationHeader,
+		DeepHealthInterval:   30 * time.Second,
+		DeepHealthTimeout:    10 * time.Second,
+		DeepHealthWeight:     0.25,
+		TraceRedact:          true,
+
+		MaxResponseHeaderBytes: 1 << 20,
+	}
+	lb.Backends = lb.newBackends(targets)
+	lb.pool = &Pool{Name: "default", Backends: append([]*Backend(nil), lb.Backends...)}
+	// Without targets (blue/green mode) the default pool is only a
+	// placeholder until SetActivePool, not a pool of its own.
+	if len(lb.Backends) > 0 {
+		lb.pools = []*Pool{lb.pool}
+	}
+	return lb
+}
+
+// AddPool registers an additional named pool. It is health-checked right
+// away but only receives traffic once made active with SetActivePool.
+func (lb *LoadBalancer) AddPool(name string, targets []BackendConfig) {
+	backends := lb.newBackends(targets)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.pools = append(lb.pools, &Pool{Name: name, Backends: backends})
+	lb.Backends = append(lb.Backends, backends...)
+}
+
+// SetActivePool atomically switches normal traffic to the named pool,
+// blue or green; other pools such as a status rule's overflow pool only
+// take the traffic routed to them. Requests already in flight finish
+// against the pool they started on.
+func (lb *LoadBalancer) SetActivePool(name string) error {
+	if name != "blue" && name != "green" {
+		return fmt.Errorf("pool %q cannot be made active: want blue or green", name)
+	}
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	n := len(lb.Backends)
+	for _, p := range lb.pools {
+		if p.Name != name {
+			continue
+		}
+		if len(p.members()) == 0 {
+			return fmt.Errorf("pool %q has no backends", name)
+		}
+		if lb.pool != p {
+			log.Printf("[pool] active pool %s -> %s", lb.pool.Name, p.Name)
+		}
+		lb.pool = p
+		return nil
+	}
+	return fmt.Errorf("unknown pool %q", name)
+}
+
+// backends returns a snapshot of every backend across all pools.
+func (lb *LoadBalancer) backends() []*Backend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return append([]*Backend(nil), lb.Backends...)
+}
+
+// RemoveBackend stops routing new requests to b, waits up to timeout for
+// its in-flight requests to finish, then removes it from every pool. It
+// reports whether b drained fully before removal.
+func (lb *LoadBalancer) RemoveBackend(b *Backend, timeout time.Duration) bool {
+	b.draining.Store(true)
+	log.Printf("[drain] %s draining (%d in flight, timeout %s)", b.Name, b.active.Load(), timeout)
+	deadline := time.Now().Add(timeout)
+	for b.active.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	drained := b.active.Load() == 0
+
+	lb.mu.Lock()
+	lb.Backends = without(lb.Backends, b)
+	pools := append([]*Pool(nil), lb.pools...)
+	lb.mu.Unlock()
+	if lb.UploadPool != nil {
+		pools = append(pools, lb.UploadPool)
+	}
+	for _, p := range pools {
+		p.mu.Lock()
+		p.Backends = without(p.Backends, b)
+		p.cw, p.ring = nil, nil
+		p.mu.Unlock()
+	}
+	b.transport.CloseIdleConnections()
+	lbActiveConns.DeleteLabelValues(b.Name)
+	log.Printf("[drain] %s removed (drained=%t, %d abandoned in flight)", b.Name, drained, b.active.Load())
+	return drained
+}
+
+func without(bs []*Backend, b *Backend) []*Backend {
+	out := make([]*Backend, 0, len(bs))
+	for _, x := range bs {
+		if x != b {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+func (lb *LoadBalancer) activePool() *Pool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.pool
+}
+
+// AddUploadPool registers a dedicated pool for large request bodies. Its
+// backends are health-checked alongside the default pool.
+func (lb *LoadBalancer) AddUploadPool(targets []BackendConfig) {
+	backends := lb.newBackends(targets)
+	lb.UploadPool = &Pool{Name: "upload", Backends: backends}
+	lb.Backends = append(lb.Backends, backends...)
+}
+
+// errNoAlive means the pool has no backend able to take traffic.
+var errNoAlive = errors.New("no alive backends")
+
+// nextAliveBackend picks the next backend from p for r using the selector
+// registered under lb.Strategy, skipping backends in tried (already
+// attempted for r) so each retry lands on a different backend. Backends
+// cooling off after a Retry-After are skipped the same way. Retries go to
+// the healthiest backend instead when RetryPreferHealthy is set.
+func (lb *LoadBalancer) nextAliveBackend(p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+	sel, ok := lookupSelector(lb.Strategy)
+	if !ok {
+		return nil, -1, fmt.Errorf("unknown strategy %q", lb.Strategy)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	skip, cooling := p.skipCooling(tried)
+	var b *Backend
+	var idx int
+	var err error
+	if lb.RetryPreferHealthy && len(tried) > 0 {
+		b, idx, err = p.nextHealthiest(skip)
+	} else {
+		b, idx, err = sel.Pick(lb, p, r, skip)
+	}
+	if errors.Is(err, errAllTried) && cooling > 0 && len(tried) == 0 {
+		err = errCoolingOff
+	}
+	return b, idx, err
+}
+
+// hasUntried reports whether a retry in p has somewhere to go: an alive
+// backend that is not in tried and not cooling off.
+func (p *Pool) hasUntried(tried map[*Backend]bool) bool {
+	now := time.Now()
+	for _, b := range p.members() {
+		if b.IsAlive() && !tried[b] && !b.coolingOff(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRoundRobin cycles through alive backends. Caller holds p.mu.
+func (p *Pool) nextRoundRobin(tried map[*Backend]bool) (*Backend, int, error) {
+	n, alive := len(p.Backends), false
 	for i := 0; i < n; i++ {
-		lb.current = (lb.current + 1) % n
-		b := lb.Backends[lb.current]
-		if b.IsAlive() {
-			return b, lb.current, nil
+		p.current = (p.current + 1) % n
+		b := p.Backends[p.current]
+		if !b.IsAlive() {
+			continue
+		}
+		alive = true
+		if !tried[b] {
+			return b, p.current, nil
 		}
 	}
-	return nil, -1, errors.New("no alive backends")
+	if alive {
+		return nil, -1, errAllTried
+	}
+	return nil, -1, errNoAlive
+}
+
+// nextWeighted is nginx-style smooth weighted round-robin over alive
+// backends; zero-weight backends never receive traffic. Caller holds p.mu.
+func (p *Pool) nextWeighted(tried map[*Backend]bool) (*Backend, int, error) {
+	if len(p.cw) != len(p.Backends) {
+		p.cw = make([]int, len(p.Backends))
+	}
+	best, total, alive := -1, 0, false
+	for i, b := range p.Backends {
+		w := b.effectiveWeight()
+		if w <= 0 || !b.IsAlive() {
+			continue
+		}
+		alive = true
+		if tried[b] {
+			continue
+		}
+		p.cw[i] += w
+		total += w
+		if best < 0 || p.cw[i] > p.cw[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		if alive {
+			return nil, -1, errAllTried
+		}
+		return nil, -1, errNoAlive
+	}
+	p.cw[best] -= total
+	return p.Backends[best], best, nil
+}
+
+// poolFor picks the pool for r based on its declared body size. Chunked
+// bodies of unknown length are treated as large when an upload pool exists.
+func (lb *LoadBalancer) poolFor(r *http.Request) *Pool {
+	if lb.UploadPool == nil || lb.UploadThreshold <= 0 {
+		return lb.activePool()
+	}
+	if r.ContentLength < 0 || r.ContentLength > lb.UploadThreshold {
+		return lb.UploadPool
+	}
+	return lb.activePool()
+}
+
+// modifyResponse runs on every upstream response before it is copied to
+// the client.
+func (lb *LoadBalancer) modifyResponse(b *Backend, resp *http.Response) error {
+	lb.noteRetryAfter(b, resp)
+	lb.noteShutdown(b, resp)
+	if st, ok := resp.Request.Context().Value(attemptKey{}).(*attemptResult); ok {
+		rule := lb.statusAction(resp.StatusCode)
+		if st.holds(rule) || lb.MaskUpstreamErrors && resp.StatusCode >= 500 {
+			st.code, st.reason, st.pool = resp.StatusCode, reasonUpstreamCode, rule.pool
+			return fmt.Errorf("upstream status %d", resp.StatusCode)
+		}
+	}
+	if lb.ResponseMode == ResponseBuffer {
+		if err := bufferResponse(resp, lb.ResponseBufferBytes); err != nil {
+			return err
+		}
+	}
+	if lb.LoadHeader != "" {
+		lb.recordLoad(b, resp.Header)
+	}
+	if lb.RewriteLocation {
+		lb.rewriteLocation(b, resp)
+	}
+	if lb.stale != nil {
+		lb.stale.record(resp)
+	}
+	if lb.sessions != nil {
+		lb.sessions.learn(b, resp)
+	}
+	if lb.CORS != nil {
+		stripCORS(resp.Header)
+	}
+	if lb.ExposeBackend {
+		resp.Header.Set("X-Backend", b.Name)
+	}
+	if !lb.ForwardTrailers && resp.Body != nil {
+		resp.Trailer = nil
+		resp.Body = &trailerStripper{ReadCloser: resp.Body, resp: resp}
+	}
+	return nil
+}
+
+// trailerStripper discards trailers that the transport merges into resp
+// when the body hits EOF, before the proxy copies them to the client.
+type trailerStripper struct {
+	io.ReadCloser
+	resp *http.Response
+}
+
+func (t *trailerStripper) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.EOF {
+		t.resp.Trailer = nil
+	}
+	return n, err
+}
+
+// proxyErrorHandler mirrors the ReverseProxy default (502) but reports a
+// body that overran MaxBodyBytes mid-stream as 413.
+func (lb *LoadBalancer) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		lb.writeError(w, r, http.StatusRequestEntityTooLarge, reasonBodyTooLarge, "request body too large")
+		return
+	}
+	log.Printf("[proxy] %s %s: %v", r.Method, r.URL.Path, err)
+	// A timeout, whether the attempt's ReqTimeout or the overall
+	// TotalTimeout, is a 504; any other upstream failure is a 502.
+	code, reason := http.StatusBadGateway, reasonUpstream
+	if r.Context().Err() == context.DeadlineExceeded {
+		code, reason = http.StatusGatewayTimeout, reasonTimeout
+	}
+	if st, ok := r.Context().Value(attemptKey{}).(*attemptResult); ok {
+		st.err = err
+		if st.code == 0 {
+			st.code, st.reason = code, reason
+		}
+		if !st.last || st.switches(st.pool) {
+			return
+		}
+		code, reason = st.code, st.reason
+	}
+	lb.writeError(w, r, code, reason, http.StatusText(code))
+}
+
+// SetMaxResponseHeaderBytes applies MaxResponseHeaderBytes to every
+// backend's transport.
+func (lb *LoadBalancer) SetMaxResponseHeaderBytes(n int64) {
+	lb.MaxResponseHeaderBytes = n
+	for _, b := range lb.backends() {
+		b.transport.MaxResponseHeaderBytes = n
+	}
+}
+
+// isHeaderOverflow reports whether err is the transport refusing a
+// response over MaxResponseHeaderBytes; net/http has no typed error for it.
+func isHeaderOverflow(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server response headers exceeded")
 }
 
+// isTLSError reports whether err is a backend certificate problem, which
+// unlike most transport errors will not go away on its own.
+func isTLSError(err error) bool {
+	var verify *tls.CertificateVerificationError
+	var unknownCA x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &verify) || errors.As(err, &unknownCA) ||
+		errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// attemptResult carries the outcome of one proxy attempt. While more
+// attempts may follow (last is false) a failure is recorded here instead
+// of being written, so the client only ever sees one response.
+type attemptResult struct {
+	// last is set when no retry can follow: the budget is spent or no
+	// untried backend is left in the pool.
+	last bool
+	// from is the attempt's pool while a status rule may still move the
+	// retry elsewhere (nil once the budget is spent or the pool is pinned).
+	from   *Pool
+	err    error
+	code   int    // status the failure would have produced
+	reason string // and its X-LB-Error-Reason
+	pool   *Pool  // where a status rule sends the retry (nil = same pool)
+	// host and scheme are what the client addressed, for rewriteLocation;
+	// the outgoing X-Forwarded-* headers may have come from the client.
+	host, scheme string
+}
+
+// holds reports whether a response under rule is held back for a retry:
+// while one can follow, or when the rule moves the retry to another pool.
+func (st *attemptResult) holds(rule statusRule) bool {
+	return rule.retry && (!st.last || st.switches(rule.pool))
+}
+
+func (st *attemptResult) switches(p *Pool) bool {
+	return p != nil && st.from != nil && p != st.from
+}
+
+type attemptKey struct{}
+
 /* ================= Serving (retries + metrics) ================= */
 
+// errTotalTimeout is the cancellation cause once TotalTimeout is spent.
+var errTotalTimeout = errors.New("total request timeout exceeded")
+
 type statusRecorder struct {
 	http.ResponseWriter
-	code int
+	code  int
+	wrote bool
+	bytes int64 // response body bytes written
 }
 
+// WriteHeader records the final status. Informational responses (100
+// Continue, 103 Early Hints) are passed through without counting as the
+// response, so a later failure can still be retried; 101 is final.
 func (s *statusRecorder) WriteHeader(code int) {
-	s.code = code
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		s.ResponseWriter.WriteHeader(code)
+		return
+	}
+	s.code, s.wrote = code, true
 	s.ResponseWriter.WriteHeader(code)
 }
 
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wrote = true
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController (used by ReverseProxy to flush
+// streaming responses) reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// retriesFor returns the retry budget for r, honoring an X-LB-Max-Retries
+// override clamped to [0, MaxRetriesCap]. The header is never forwarded.
+func (lb *LoadBalancer) retriesFor(r *http.Request) int {
+	v := r.Header.Get("X-LB-Max-Retries")
+	r.Header.Del("X-LB-Max-Retries")
+	if v == "" {
+		return lb.MaxRetries
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return lb.MaxRetries
+	}
+	return min(n, lb.MaxRetriesCap)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isEventStream reports whether the client asked for Server-Sent Events.
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	lb.inFlight.Add(1)
+	defer lb.inFlight.Add(-1)
 	rec := &statusRecorder{ResponseWriter: w, code: 200}
 
+	// route labels metrics with the pool that served the request, which
+	// keeps cardinality bounded to configured pools; "none" means the
+	// request was rejected before routing.
+	route := "none"
+	var last *Backend
+	attempts := 0
+	var sequence []string // backends attempted, in order
+	tier := ""
+	if lb.tiers != nil {
+		tier = lb.tiers.tier(r)
+	}
+	tr := lb.startTrace(r, start)
+	defer func() {
+		tr.finish(lb.traceLog, rec.code)
+		lb.countRequest(route, rec.code, r.Method)
+		if lb.ResponseSizeMetrics {
+			lbResponseBytes.WithLabelValues(route).Observe(float64(rec.bytes))
+		}
+		if lb.AttemptTrace {
+			log.Printf("[trace] %s %s id=%s status=%d attempts=%s", r.Method, r.URL.Path,
+				r.Header.Get(lb.RequestIDHeader), rec.code, strings.Join(sequence, ","))
+		}
+		lb.logSlow(r, route, last, rec.code, time.Since(start))
+		lb.requestDone(r, RequestInfo{Pool: route, Backend: last, Attempts: attempts, Sequence: sequence,
+			Status: rec.code, Duration: time.Since(start), Tier: tier})
+	}()
+
+	if !lb.handleHTTP10(rec, r) || !lb.methodAllowed(rec, r) || lb.tenantLimited(rec, r, tier) {
+		return
+	}
+	if r.Method == http.MethodConnect && len(lb.ConnectAllow) > 0 {
+		route = "connect"
+		lb.serveConnect(rec, r)
+		return
+	}
+
+	if lb.MaxBodyBytes > 0 {
+		if r.ContentLength > lb.MaxBodyBytes {
+			lb.writeError(rec, r, http.StatusRequestEntityTooLarge, reasonBodyTooLarge, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, lb.MaxBodyBytes)
+	}
+	pool := lb.poolFor(r)
+	pinned, ok := lb.pinnedPool(rec, r)
+	if !ok {
+		return
+	}
+	if pinned != nil {
+		pool = pinned
+	}
+	route = pool.Name
+	if lb.shedDegraded(rec, r, pool) {
+		return
+	}
+
+	// While the whole pool is down, shed load instantly instead of spending
+	// ReqTimeout x retries per request; a single probe per interval still
+	// goes through so recovery is noticed.
+	probing := false
+	if lb.PoolFailFast && pool.open.Load() {
+		if !pool.allowProbe(lb.PoolProbeInterval) {
+			if !lb.serveStale(rec, r) {
+				lb.noUpstream(rec, r)
+			}
+			return
+		}
+		probing = true
+	}
+
+	// SSE streams are long-lived: no per-attempt timeout, no server write
+	// deadline and no retry once the stream has started.
+	stream := isEventStream(r)
+	maxRetries := lb.retriesFor(r)
+	if probing || pinned != nil {
+		maxRetries = 0
+	}
+	if stream {
+		maxRetries = 0
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+
+	var captured *cappedBuffer
+	if lb.DeadLetterURL != "" && r.Body != nil && r.Body != http.NoBody {
+		captured = &cappedBuffer{limit: lb.DeadLetterMaxBody}
+		r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, captured), Closer: r.Body}
+	}
+
+	// RetryAllBackends lets idempotent requests try every alive backend
+	// once; the loop then ends when the selector reports errAllTried.
+	retryAll := lb.RetryAllBackends && isIdempotent(r.Method) && !stream
+
+	if expectsContinue(r) && lb.ExpectContinue == ExpectLocal {
+		r.Header.Del("Expect")
+	}
+	// A body consumed by a failed attempt cannot be resent, so retried
+	// (and mirrored) requests buffer it up front or give up on retrying.
+	var body []byte
+	mirror := lb.shouldMirror(r)
+	if maxRetries > 0 || retryAll || mirror {
+		buf, ok, err := lb.replayBody(r)
+		if err != nil {
+			lb.writeBodyError(rec, r, err)
+			return
+		}
+		if !ok {
+			maxRetries, retryAll, mirror = 0, false, false
+		}
+		body = buf
+	}
+	if mirror {
+		lb.mirror(r, body)
+	}
+
+	// Attempt contexts derive from parent, so with TotalTimeout set each
+	// attempt's deadline shrinks to whatever is left of the overall budget.
+	parent := r.Context()
+	if lb.TotalTimeout > 0 && !stream {
+		var cancelTotal context.CancelFunc
+		parent, cancelTotal = context.WithDeadlineCause(parent, start.Add(lb.TotalTimeout), errTotalTimeout)
+		defer cancelTotal()
+	}
+
 	var lastErr error
-	tried := map[int]bool{}
-	for attempt := 0; attempt <= lb.MaxRetries; attempt++ {
-		b, idx, err := lb.nextAliveBackend()
+	var failure *attemptResult // last held-back attempt failure
+	succeeded := false
+	tried := map[*Backend]bool{}
+	// Every iteration is a real attempt on a distinct backend: selectors
+	// skip tried backends, and once none are left the loop stops instead of
+	// spending the remaining budget.
+	for retryAll || attempts <= maxRetries {
+		if parent.Err() != nil {
+			if attempts == 0 {
+				lb.writeError(rec, r, http.StatusGatewayTimeout, reasonTimeout, "request timed out")
+			}
+			break
+		}
+		// A learned session goes back to its backend first; retries and
+		// unknown sessions use the strategy.
+		var err error
+		b, _, ok := lb.sessionBackend(pool, r, tried)
+		if !ok {
+			t0 := time.Now()
+			b, _, err = lb.nextAliveBackend(pool, r, tried)
+			lbSelectionSeconds.WithLabelValues(lb.Strategy).Observe(time.Since(t0).Seconds())
+		}
+		if err == nil && tried[b] {
+			err = errAllTried // a selector ignoring tried must not loop forever
+		}
+		if errors.Is(err, errAllTried) {
+			lbRetriesExhaustedTotal.WithLabelValues(route).Inc()
+			break
+		}
 		if err != nil {
 			lastErr = err
+			if lb.PoolFailFast && pinned == nil && errors.Is(err, errNoAlive) {
+				pool.setOpen(true)
+			}
 			break
 		}
-		if tried[idx] {
-			continue
+		tried[b] = true
+		last = b
+		attempts++
+		sequence = append(sequence, b.Name)
+		if lb.AttemptTrace {
+			rec.Header().Set("X-LB-Trace", strings.Join(sequence, ","))
 		}
-		tried[idx] = true
-		lbAttemptsTotal.WithLabelValues(b.Name).Inc()
+		lbAttemptsTotal.WithLabelValues(route, b.Name).Inc()
+		b.windowAttempts.Add(1)
 
-		ctx, cancel := context.WithTimeout(r.Context(), lb.ReqTimeout)
-		r2 := r.Clone(ctx)
-		r2.Header.Set("X-Forwarded-Host", r.Host)
-		r2.Header.Set("X-Forwarded-For", clientIP(r))
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if stream {
+			ctx, cancel = context.WithCancel(parent)
+		} else {
+			ctx, cancel = context.WithTimeout(parent, lb.reqTimeoutFor(b))
+		}
+		spent := !retryAll && attempts > maxRetries
+		st := &attemptResult{last: spent || !pool.hasUntried(tried), host: r.Host, scheme: schemeOf(r)}
+		if !spent && pinned == nil {
+			st.from = pool
+		}
+		var firstByte atomic.Int64 // unix nanos; set on the transport's goroutine
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if info.Reused {
+					b.conns.reused.Add(1)
+				}
+			},
+			GotFirstResponseByte: func() { firstByte.Store(time.Now().UnixNano()) },
+		}
+		r2 := r.Clone(httptrace.WithClientTrace(context.WithValue(ctx, attemptKey{}, st), trace))
+		if body != nil {
+			setBody(r2, body)
+		}
+		lb.sanitizeForwarded(r2.Header, r)
+		if r.Host != "" {
+			r2.Header.Set("X-Forwarded-Host", r.Host)
+		}
+		r2.Header.Set("X-Forwarded-For", lb.clientIP(r))
 		r2.Header.Set("X-Forwarded-Proto", schemeOf(r))
+		if lb.ForwardedPort {
+			r2.Header.Set("X-Forwarded-Port", forwardedPort(r))
+		}
+		if lb.ForwardedServer != "" {
+			r2.Header.Set("X-Forwarded-Server", lb.ForwardedServer)
+		}
+		for k, v := range b.headers {
+			r2.Header[k] = v
+		}
 
+		active := lbActiveConns.WithLabelValues(b.Name)
+		active.Inc()
+		b.active.Add(1)
+		began := time.Now()
 		b.ReverseProxy.ServeHTTP(rec, r2)
+		b.active.Add(-1)
+		active.Dec()
 		cancel()
+		if fb := firstByte.Load(); fb != 0 {
+			first := time.Unix(0, fb)
+			lbBackendTTFBSeconds.WithLabelValues(b.Name).Observe(first.Sub(began).Seconds())
+			if rec.wrote && !stream {
+				lbTransferSeconds.WithLabelValues(route).Observe(time.Since(first).Seconds())
+			}
+		}
+		status := st.code // held back for a retry
+		if rec.wrote {
+			status = rec.code
+		}
+		tr.attempt(b, route, began, status, st.err)
 
-		// retry on timeout or 5xx
-		if ctx.Err() == context.DeadlineExceeded || rec.code >= 500 {
+		// retry on timeout, 5xx or a status rule
+		if ctx.Err() == context.DeadlineExceeded || st.err != nil || rec.code >= 500 {
 			reason := "timeout"
-			if rec.code >= 500 {
+			switch {
+			case isTLSError(st.err):
+				reason = "tls"
+			case isHeaderOverflow(st.err):
+				reason = "headers"
+				lbOversizedHeaders.WithLabelValues(b.Name).Inc()
+			case ctx.Err() == context.DeadlineExceeded:
+			case st.code > 0 && st.code < 500:
+				reason = "status" // rerouted by a status rule, not a backend fault
+			default:
 				reason = "5xx"
 			}
-			lbFailuresTotal.WithLabelValues(b.Name, reason).Inc()
-			lb.noteFailure(b)
+			lbFailuresTotal.WithLabelValues(route, b.Name, reason).Inc()
+			if reason == "tls" && lb.TLSErrorTripsBreaker {
+				lb.tripBreaker(b)
+			} else if reason != "status" {
+				lb.noteFailure(b)
+			}
+			if st.err != nil {
+				failure = st
+			}
+			if rec.wrote {
+				break // a status rule passed the response through
+			}
+			if st.pool != nil && st.pool != pool && pinned == nil {
+				pool, route, tried = st.pool, st.pool.Name, map[*Backend]bool{}
+			}
 			continue
 		}
 
 		// success
+		lb.noteSuccess(b)
+		pool.setOpen(false)
+		succeeded = true
 		break
 	}
 
-	lbLatencySeconds.Observe(time.Since(start).Seconds())
-	lbRequestsTotal.WithLabelValues(fmt.Sprintf("%d", rec.code), r.Method).Inc()
+	elapsed := time.Since(start)
+	lbLatencySeconds.WithLabelValues(route).Observe(elapsed.Seconds())
+	lb.trackSLO(elapsed)
+
+	// No alive backend is a capacity problem (503); backends that were
+	// tried and failed answer with the last failure: 502, 504 or the
+	// backend's own 5xx status.
+	if lastErr != nil && attempts == 0 && !lb.serveStale(rec, r) {
+		lb.noUpstream(rec, r)
+	} else if !rec.wrote && failure != nil {
+		lb.writeError(rec, r, failure.code, failure.reason, http.StatusText(failure.code))
+	} else if !rec.wrote && !succeeded {
+		// never leave the client with an implicit empty 200
+		lb.writeError(rec, r, http.StatusBadGateway, reasonUpstream, "no upstream response")
+	}
+	if !succeeded && lb.DeadLetterURL != "" {
+		go lb.sendDeadLetter(newDeadLetter(r, lb.clientIP(r), rec.code, captured))
+	}
+}
+
+// noUpstream answers 503 with a Retry-After hint of RetryAfter, roughly
+// when health checks could have brought a backend back.
+func (lb *LoadBalancer) noUpstream(w http.ResponseWriter, r *http.Request) {
+	if lb.RetryAfter > 0 {
+		secs := int((lb.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	lb.writeError(w, r, http.StatusServiceUnavailable, reasonNoUpstream, "no upstream available")
+}
+
+// countRequest increments lb_requests_total with bounded labels: unknown
+// methods collapse to OTHER and, with GroupStatusCodes, codes to "2xx" etc.
+func (lb *LoadBalancer) countRequest(route string, code int, method string) {
+	lbRequestsTotal.WithLabelValues(route, lb.codeLabel(code), methodLabel(method)).Inc()
+}
+
+// codeLabel is the code label for lb_requests_total; 0 (no response was
+// written) is "none" rather than a made-up "0xx" class.
+func (lb *LoadBalancer) codeLabel(code int) string {
+	if code == 0 {
+		return "none"
+	}
+	if lb.GroupStatusCodes || code < 100 || code > 599 {
+		return fmt.Sprintf("%dxx", code/100)
+	}
+	return strconv.Itoa(code)
+}
+
+func methodLabel(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return m
+	}
+	return "OTHER"
+}
+
+func (lb *LoadBalancer) trackSLO(elapsed time.Duration) {
+	if lb.SLOThreshold <= 0 {
+		return
+	}
+	if elapsed > lb.SLOThreshold {
+		lbSLOViolationsTotal.Inc()
+	}
+	lb.sloMu.Lock()
+	defer lb.sloMu.Unlock()
+	lb.sloTotal++
+	if elapsed > lb.SLOThreshold {
+		lb.sloViolations++
+	}
+	lbSLOViolationRatio.Set(float64(lb.sloViolations) / float64(lb.sloTotal))
+}
 
-	if lastErr != nil {
-		http.Error(w, "no upstream available", http.StatusServiceUnavailable)
+// logSlow writes a WARN line for requests slower than SlowThreshold,
+// separate from the per-request [LB] log, and counts them.
+func (lb *LoadBalancer) logSlow(r *http.Request, route string, b *Backend, code int, elapsed time.Duration) {
+	if lb.SlowThreshold <= 0 || elapsed <= lb.SlowThreshold {
+		return
+	}
+	lbSlowRequestsTotal.WithLabelValues(route).Inc()
+	backend := "-"
+	if b != nil {
+		backend = b.Name
 	}
+	log.Printf("[slow] level=WARN method=%s path=%q route=%s backend=%s status=%d duration=%s id=%s",
+		r.Method, r.URL.Path, route, backend, code, elapsed.Round(time.Millisecond), r.Header.Get(lb.RequestIDHeader))
 }
 
 /* ================= Health checks & breaker ================= */
@@ -196,57 +1591,294 @@ func (lb *LoadBalancer) noteFailure(b *Backend) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.ConsecFailures++
+	b.suspect, b.okStreak = true, 0
+	lb.decayWeight(b)
 	if b.ConsecFailures >= lb.MaxConsecFail && b.Alive {
 		log.Printf("[breaker] marking %s DOWN after %d failures", b.Name, b.ConsecFailures)
-		b.Alive = false
+		b.setAliveLocked(false)
+		b.openedAt = time.Now()
+		b.setBreaker(breakerOpen)
+		lbBreakerOpensTotal.WithLabelValues(b.Name).Inc()
 		go func(be *Backend) {
 			time.Sleep(lb.BreakerCooldown)
 			be.mu.Lock()
-			be.Alive = true
+			be.setAliveLocked(true)
 			be.ConsecFailures = 0
+			be.setBreaker(breakerHalfOpen)
+			lbBreakerOpenSeconds.WithLabelValues(be.Name).Set(time.Since(be.openedAt).Seconds())
 			be.mu.Unlock()
 			log.Printf("[breaker] cooldown over: marking %s UP (trial)", be.Name)
 		}(b)
 	}
 }
 
+// tripBreaker opens b's breaker on this failure regardless of how many
+// came before, for errors that retrying will not fix.
+func (lb *LoadBalancer) tripBreaker(b *Backend) {
+	b.mu.Lock()
+	b.ConsecFailures = max(b.ConsecFailures, lb.MaxConsecFail-1)
+	b.mu.Unlock()
+	lb.noteFailure(b)
+}
+
+// noteSuccess closes a half-open breaker once a trial request succeeds.
+func (lb *LoadBalancer) noteSuccess(b *Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ConsecFailures = 0
+	lb.recoverWeight(b)
+	if b.breaker == breakerHalfOpen {
+		b.setBreaker(breakerClosed)
+		log.Printf("[breaker] %s trial succeeded: closed", b.Name)
+	}
+}
+
+// stableProbes is how many consecutive successful probes clear a backend's
+// suspect flag and return it to the normal probe interval.
+const stableProbes = 3
+
+// StartHealthChecks probes each backend on its own schedule: every
+// HealthInterval normally, every HealthInterval/4 while it is suspect
+// (recent probe or request failures) so recovery is noticed sooner. Each
+// tick also refreshes lb_backend_down_duration_seconds. A backend whose
+// previous probe is still running skips that turn (result="skipped").
 func (lb *LoadBalancer) StartHealthChecks() {
-	t := time.NewTicker(lb.HealthInterval)
+	t := time.NewTicker(lb.HealthInterval / 4)
 	go func() {
-		for range t.C {
-			for _, b := range lb.Backends {
-				go lb.check(b)
+		for now := range t.C {
+			lb.updateDegraded()
+			for _, b := range lb.backends() {
+				lbBackendDownSeconds.WithLabelValues(b.Name).Set(b.downFor(now).Seconds())
+				if !b.dueForCheck(now, lb.HealthInterval) {
+					continue
+				}
+				if !b.probing.CompareAndSwap(false, true) {
+					lbHealthChecksTotal.WithLabelValues(b.Name, "skipped").Inc()
+					continue
+				}
+				go func(b *Backend) {
+					defer b.probing.Store(false)
+					lb.check(b)
+				}(b)
 			}
 		}
 	}()
 }
 
-func (lb *LoadBalancer) check(b *Backend) {
-	client := &http.Client{Timeout: lb.HealthTimeout}
-	resp, err := client.Get(b.URL.String() + lb.HealthPath)
-	if err != nil || resp.StatusCode != 200 {
-		if err != nil {
-			log.Printf("[health] %s unhealthy: %v", b.Name, err)
-		} else {
-			log.Printf("[health] %s unhealthy: status=%d", b.Name, resp.StatusCode)
-			resp.Body.Close()
-		}
-		b.SetAlive(false)
+// dueForCheck reports whether b should be probed at now and, if so,
+// schedules its next probe.
+func (b *Backend) dueForCheck(now time.Time, interval time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.nextCheck) {
+		return false
+	}
+	if b.suspect {
+		interval /= 4
+	}
+	b.nextCheck = now.Add(interval)
+	return true
+}
+
+// markProbe records a probe result for adaptive scheduling.
+func (b *Backend) markProbe(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !ok {
+		b.suspect, b.okStreak = true, 0
 		return
 	}
-	resp.Body.Close()
+	b.okStreak++
+	if b.okStreak >= stableProbes {
+		b.suspect = false
+	}
+}
+
+// check probes b once and applies the result. It returns the probe error
+// and is safe to run alongside the background checker.
+func (lb *LoadBalancer) check(b *Backend) error {
+	t0 := time.Now()
+	err := lb.probe(b)
+	took := time.Since(t0).Seconds()
+	lbHealthCheckSeconds.WithLabelValues(b.Name).Observe(took)
+	b.markProbe(err == nil)
+	if lb.HealthWeighting {
+		lb.scoreProbe(b, err == nil, took)
+	}
+	if err != nil {
+		lbHealthChecksTotal.WithLabelValues(b.Name, "failure").Inc()
+		lb.logUnhealthy(b, err)
+		b.SetAlive(false)
+		return err
+	}
+	lbHealthChecksTotal.WithLabelValues(b.Name, "success").Inc()
+	lb.clearShutdown(b)
+	if ready, streak := b.rise(lb.HealthRiseThreshold); !ready {
+		log.Printf("[health] %s passing probe %d/%d", b.Name, streak, lb.HealthRiseThreshold)
+		return nil
+	}
+	if b.shutdownAt.Load() != 0 {
+		b.SetAlive(true) // still held out of selection by its shutdown signal
+		return nil
+	}
 	if !b.IsAlive() {
 		log.Printf("[health] %s back healthy", b.Name)
+		go lb.warm(b)
 	}
 	b.SetAlive(true)
+	for _, p := range lb.allPools() {
+		if p.open.Load() && p.contains(b) {
+			p.setOpen(false)
+		}
+	}
+	return nil
 }
 
-/* ================= Helpers ================= */
+// logUnhealthy logs a failed probe when b goes down, then at most once
+// per HealthLogInterval for as long as it stays down, with a count of the
+// failures in between.
+func (lb *LoadBalancer) logUnhealthy(b *Backend, err error) {
+	now := time.Now()
+	b.mu.Lock()
+	due := b.Alive || lb.HealthLogInterval <= 0 || now.Sub(b.downLoggedAt) >= lb.HealthLogInterval
+	if !due {
+		b.downSuppressed++
+		b.mu.Unlock()
+		return
+	}
+	suppressed, alive := b.downSuppressed, b.Alive
+	b.downLoggedAt, b.downSuppressed = now, 0
+	b.mu.Unlock()
+	if alive || suppressed == 0 {
+		log.Printf("[health] %s unhealthy: %v", b.Name, err)
+		return
+	}
+	log.Printf("[health] %s still unhealthy (%d failed probes not logged): %v", b.Name, suppressed, err)
+}
+
+// probe runs one health check of the configured type against b.
+func (lb *LoadBalancer) probe(b *Backend) error {
+	if lb.HealthCheckType == HealthCheckGRPC {
+		return lb.probeGRPC(b)
+	}
+	return lb.probePath(b, lb.HealthPath, lb.HealthTimeout)
+}
+
+// probePath GETs path on b over a fresh connection and wants a 200. A
+// probe through the proxy's idle pool could pass on a warm connection
+// while new dials fail.
+func (lb *LoadBalancer) probePath(b *Backend, path string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout, Transport: b.probeTransport}
+	resp, err := client.Get(b.target.String() + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+/* ================= Client IP ================= */
+
+func (lb *LoadBalancer) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range lb.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the originating client address. Forwarded headers are
+// ignored unless the direct peer is a trusted proxy, so a client talking to
+// the LB directly cannot spoof its address.
+func (lb *LoadBalancer) clientIP(r *http.Request) string {
+	peer := remoteHost(r)
+	trusted := lb.isTrusted(net.ParseIP(peer))
+	for _, src := range lb.IPSources {
+		switch src {
+		case "x-forwarded-for":
+			if !trusted {
+				continue
+			}
+			// walk right-to-left, skipping our own trusted hops; a proxy
+			// may add its own header line rather than append, so join them
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[i]))
+				if ip == nil {
+					break
+				}
+				if !lb.isTrusted(ip) || i == 0 {
+					return ip.String()
+				}
+			}
+		case "x-real-ip":
+			if !trusted {
+				continue
+			}
+			if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+				return ip.String()
+			}
+		case "remote":
+			return peer
+		}
+	}
+	return peer
+}
+
+// parseTrustedProxies accepts a comma-separated list of IPs and CIDRs.
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
 
-func clientIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+func parseIPSources(v string) ([]string, error) {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch s {
+		case "":
+			continue
+		case "x-forwarded-for", "x-real-ip", "remote":
+			out = append(out, s)
+		default:
+			return nil, fmt.Errorf("unknown client ip source %q", s)
+		}
 	}
+	return out, nil
+}
+
+/* ================= Helpers ================= */
+
+func remoteHost(r *http.Request) string {
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
 	if host == "" {
 		return r.RemoteAddr
@@ -254,6 +1886,25 @@ func clientIP(r *http.Request) string {
 	return host
 }
 
+// forwardedPort is the port the client connected to: the one in the Host
+// header when the client gave one (non-standard ports), otherwise the
+// port of the listener that accepted the request, falling back to the
+// scheme's default.
+func forwardedPort(r *http.Request) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if r.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
+
 func schemeOf(r *http.Request) string {
 	if r.TLS != nil {
 		return "https"
@@ -261,9 +1912,10 @@ func schemeOf(r *http.Request) string {
 	return "http"
 }
 
-func logMiddleware(next http.Handler) http.Handler {
+// logMiddleware logs each request along with its correlation ID.
+func logMiddleware(idHeader string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[LB] %s %s", r.Method, r.URL.Path)
+		log.Printf("[LB] %s %s id=%s", r.Method, r.URL.Path, r.Header.Get(idHeader))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -275,32 +1927,575 @@ func getenv(k, def string) string {
 	return def
 }
 
+// The typed getenv helpers exit on a bad value; each has an
+// error-returning form that -validate shares (see typedEnv).
+
+func getenvInt64(k string, def int64) int64 {
+	n, err := envInt64(k, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func envInt64(k string, def int64) (int64, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer for %s=%q: %v", k, v, err)
+	}
+	return n, nil
+}
+
+// splitList splits a comma-separated env value, trimming blanks.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func getenvBool(k string, def bool) bool {
+	b, err := envBool(k, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+func envBool(k string, def bool) (bool, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean for %s=%q: %v", k, v, err)
+	}
+	return b, nil
+}
+
+// getenvFraction reads a number between 0 and 1.
+func getenvFraction(k string, def float64) float64 {
+	f, err := envFraction(k, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func envFraction(k string, def float64) (float64, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid fraction for %s=%q: want a number between 0 and 1", k, v)
+	}
+	return f, nil
+}
+
+func getenvDuration(k string, def time.Duration) time.Duration {
+	d, err := envDuration(k, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+func envDuration(k string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for %s=%q: %v", k, v, err)
+	}
+	return d, nil
+}
+
+/* ================= Readiness & drain ================= */
+
+// draining flips to true on SIGTERM/SIGINT so /readyz fails and the
+// orchestrator stops routing to us before the listener is shut down.
+var draining atomic.Bool
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "DRAINING")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "READY")
+}
+
+// drainOnSignal waits for SIGTERM/SIGINT, fails readiness, keeps serving for
+// preStop, then gracefully shuts the server (and admin server, if any) down
+// within timeout.
+func drainOnSignal(srv, adminSrv *http.Server, preStop, timeout time.Duration, done chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	s := <-sig
+	log.Printf("[drain] received %s: failing /readyz, waiting %s before shutdown", s, preStop)
+	draining.Store(true)
+	time.Sleep(preStop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("[drain] shutdown: %v", err)
+	}
+	// the admin listener goes last so metrics stay scrapable while draining
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			log.Printf("[drain] admin shutdown: %v", err)
+		}
+	}
+	close(done)
+}
+
 /* ================= main ================= */
 
 func main() {
-	targetsEnv := getenv("BACKENDS", "http://backend1:8081,http://backend2:8081,http://backend3:8081")
-	targets := strings.Split(targetsEnv, ",")
-	for i := range targets {
-		targets[i] = strings.TrimSpace(targets[i])
+	validate := flag.Bool("validate", false, "check the configuration in the environment, print a report and exit")
+	flag.Parse()
+	if *validate {
+		os.Exit(validateConfig(os.Stdout))
+	}
+
+	// blue/green mode replaces the single BACKENDS pool with two named pools
+	blue, green := getenv("BLUE_BACKENDS", ""), getenv("GREEN_BACKENDS", "")
+	var targets []BackendConfig
+	var err error
+	switch {
+	case blue != "":
+	case getenv("BACKENDS_JSON", "") != "":
+		targets, err = parseBackendsJSON(getenv("BACKENDS_JSON", ""))
+	default:
+		targets, err = parseBackendsCSV(getenv("BACKENDS", "http://backend1:8081,http://backend2:8081,http://backend3:8081"))
+	}
+	if err != nil {
+		log.Fatalf("backends: %v", err)
 	}
 
 	lb := NewLoadBalancer(targets)
+	if blue != "" {
+		for _, p := range [][2]string{{"blue", blue}, {"green", green}} {
+			cfgs, err := parseBackendsCSV(p[1])
+			if err != nil {
+				log.Fatalf("%s pool: %v", p[0], err)
+			}
+			lb.AddPool(p[0], cfgs)
+		}
+		if err := lb.SetActivePool(getenv("ACTIVE_POOL", "blue")); err != nil {
+			log.Fatalf("ACTIVE_POOL: %v", err)
+		}
+	}
+	st := getenv("LB_STRATEGY", StrategyRoundRobin)
+	if _, ok := lookupSelector(st); !ok {
+		log.Fatalf("unknown LB_STRATEGY %q (registered: %s)", st, strings.Join(selectorNames(), ", "))
+	}
+	lb.Strategy = st
+	lb.AdaptiveLow = getenv("ADAPTIVE_LOW_STRATEGY", lb.AdaptiveLow)
+	lb.AdaptiveHigh = getenv("ADAPTIVE_HIGH_STRATEGY", lb.AdaptiveHigh)
+	lb.AdaptiveLowWater = getenvInt64("ADAPTIVE_LOW_WATER", lb.AdaptiveLowWater)
+	lb.AdaptiveHighWater = getenvInt64("ADAPTIVE_HIGH_WATER", lb.AdaptiveHighWater)
+	if st == StrategyAdaptive {
+		if err := checkAdaptive(lb.AdaptiveLow, lb.AdaptiveHigh, lb.AdaptiveLowWater, lb.AdaptiveHighWater); err != nil {
+			log.Fatalf("adaptive strategy: %v", err)
+		}
+	}
+	lb.HashFallbackDepth = int(getenvInt64("HASH_FALLBACK_DEPTH", 0))
+
+	if v := getenv("UPLOAD_BACKENDS", ""); v != "" {
+		uploads, err := parseBackendsCSV(v)
+		if err != nil {
+			log.Fatalf("UPLOAD_BACKENDS: %v", err)
+		}
+		lb.AddUploadPool(uploads)
+		lb.UploadThreshold = getenvInt64("UPLOAD_THRESHOLD_BYTES", 10<<20)
+		log.Printf("Upload backends (> %d bytes): %v", lb.UploadThreshold, splitList(v))
+	}
+	if v := getenv("OVERFLOW_BACKENDS", ""); v != "" {
+		overflow, err := parseBackendsCSV(v)
+		if err != nil {
+			log.Fatalf("OVERFLOW_BACKENDS: %v", err)
+		}
+		lb.AddPool("overflow", overflow)
+	}
+	if v := getenv("MIRROR_BACKENDS", ""); v != "" {
+		mirrors, err := parseBackendsCSV(v)
+		if err != nil {
+			log.Fatalf("MIRROR_BACKENDS: %v", err)
+		}
+		pct, err := strconv.ParseFloat(getenv("MIRROR_PERCENT", "100"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			log.Fatalf("MIRROR_PERCENT: want a number between 0 and 100")
+		}
+		lb.MirrorPercent = pct
+		lb.MirrorTimeout = getenvDuration("MIRROR_TIMEOUT", lb.ReqTimeout)
+		lb.MirrorMaxInFlight = int(getenvInt64("MIRROR_MAX_IN_FLIGHT", 100))
+		if lb.MirrorMaxInFlight <= 0 {
+			log.Fatalf("MIRROR_MAX_IN_FLIGHT must be positive, got %d", lb.MirrorMaxInFlight)
+		}
+		lb.AddMirrorPool(mirrors)
+		log.Printf("Mirroring %g%% of requests to: %v", pct, splitList(v))
+	}
+	lb.MaxBodyBytes = getenvInt64("MAX_BODY_BYTES", 0)
+	lb.RetryBodyBytes = getenvInt64("RETRY_BODY_BYTES", lb.RetryBodyBytes)
+	expectMode, err := parseExpectMode(getenv("EXPECT_CONTINUE", lb.ExpectContinue))
+	if err != nil {
+		log.Fatalf("EXPECT_CONTINUE: %v", err)
+	}
+	lb.ExpectContinue = expectMode
+	responseMode, err := parseResponseMode(getenv("RESPONSE_MODE", lb.ResponseMode))
+	if err != nil {
+		log.Fatalf("RESPONSE_MODE: %v", err)
+	}
+	lb.ResponseMode = responseMode
+	lb.ResponseBufferBytes = getenvInt64("RESPONSE_BUFFER_BYTES", lb.ResponseBufferBytes)
+	lb.SetMaxResponseHeaderBytes(getenvInt64("MAX_RESPONSE_HEADER_BYTES", lb.MaxResponseHeaderBytes))
+	lb.MaxRetriesCap = int(getenvInt64("MAX_RETRIES_CAP", int64(lb.MaxRetriesCap)))
+	lb.RetryAllBackends = getenvBool("RETRY_ALL_BACKENDS", false)
+	lb.RetryPreferHealthy = getenvBool("RETRY_PREFER_HEALTHY", false)
+	lb.TotalTimeout = getenvDuration("TOTAL_TIMEOUT", 0)
+	lb.TLSErrorTripsBreaker = getenvBool("TLS_ERROR_TRIPS_BREAKER", false)
+	lb.RetryAfter = getenvDuration("RETRY_AFTER", lb.RetryAfter)
+	lb.BackendRetryAfterMax = getenvDuration("BACKEND_RETRY_AFTER_MAX", lb.BackendRetryAfterMax)
+	dialMode, err := parseDialMode(getenv("DIAL_MODE", DialDualStack))
+	if err != nil {
+		log.Fatalf("DIAL_MODE: %v", err)
+	}
+	lb.DialMode = dialMode
+	lb.DialTimeout = getenvDuration("DIAL_TIMEOUT", lb.DialTimeout)
+	lb.DialFallbackDelay = getenvDuration("DIAL_FALLBACK_DELAY", lb.DialFallbackDelay)
+	lb.MaxConnAge = getenvDuration("BACKEND_MAX_CONN_AGE", 0)
+	if cookie, hint := getenv("SESSION_COOKIE", ""), getenv("SESSION_HINT_HEADER", ""); cookie != "" || hint != "" {
+		lb.sessions = newSessionAffinity(cookie, hint,
+			getenvDuration("SESSION_TTL", 30*time.Minute), int(getenvInt64("SESSION_MAX_ENTRIES", 10000)))
+	}
+	if limits, def := getenv("TENANT_LIMITS", ""), getenv("TENANT_DEFAULT_LIMIT", ""); limits != "" || def != "" {
+		m, err := parseTenantLimits(limits)
+		if err != nil {
+			log.Fatalf("TENANT_LIMITS: %v", err)
+		}
+		var d rateLimit
+		if def != "" {
+			if d, err = parseRateLimit(def); err != nil {
+				log.Fatalf("TENANT_DEFAULT_LIMIT: %v", err)
+			}
+		}
+		lb.tenants = newTenantLimiter(http.CanonicalHeaderKey(getenv("TENANT_HEADER", "X-Tenant-ID")), m, d,
+			getenvDuration("TENANT_IDLE_TTL", 10*time.Minute))
+	}
+	if claim := getenv("JWT_TIER_CLAIM", ""); claim != "" {
+		lb.tiers = newTierExtractor(claim, getenv("JWT_SIGNING_KEY", ""), getenv("JWT_DEFAULT_TIER", "default"))
+	}
+	if v := getenv("TIER_LIMITS", ""); v != "" {
+		if lb.tiers == nil {
+			log.Fatal("TIER_LIMITS needs JWT_TIER_CLAIM")
+		}
+		m, err := parseTenantLimits(v)
+		if err != nil {
+			log.Fatalf("TIER_LIMITS: %v", err)
+		}
+		lb.tierLimits = newTenantLimiter("", m, rateLimit{}, getenvDuration("TENANT_IDLE_TTL", 10*time.Minute))
+	}
+	if getenvBool("SERVE_STALE", false) {
+		lb.stale = newStaleCache(int(getenvInt64("STALE_MAX_ENTRIES", 1000)), int(getenvInt64("STALE_MAX_BODY", 1<<20)))
+	}
+	lb.AdminToken = getenv("ADMIN_TOKEN", "")
+	lb.PoolFailFast = getenvBool("POOL_FAIL_FAST", false)
+	lb.PoolProbeInterval = getenvDuration("POOL_PROBE_INTERVAL", lb.PoolProbeInterval)
+	lb.SLOThreshold = getenvDuration("SLO_THRESHOLD", 0)
+	lb.SlowThreshold = getenvDuration("SLOW_REQUEST_THRESHOLD", 0)
+	lb.ConnHighWater = getenvInt64("CONN_HIGH_WATER", 0)
+	lb.ExposeBackend = getenvBool("EXPOSE_BACKEND_HEADER", false)
+	lb.MaskUpstreamErrors = getenvBool("MASK_UPSTREAM_ERRORS", false)
+	if getenvBool("FORWARD_PROXY", false) {
+		allow, err := parseConnectAllow(getenv("CONNECT_ALLOW", ""))
+		if err == nil && len(allow) == 0 {
+			err = errors.New("FORWARD_PROXY needs at least one destination")
+		}
+		if err != nil {
+			log.Fatalf("CONNECT_ALLOW: %v", err)
+		}
+		lb.ConnectAllow = allow
+		log.Printf("Forward proxy: CONNECT allowed to %v", splitList(getenv("CONNECT_ALLOW", "")))
+	}
+	rules, err := parseStatusRules(getenv("STATUS_RETRY_RULES", ""), lb.poolNamed)
+	if err != nil {
+		log.Fatalf("STATUS_RETRY_RULES: %v", err)
+	}
+	lb.StatusRules = rules
+	lb.AttemptTrace = getenvBool("ATTEMPT_TRACE", false)
+	traceMatch, err := parseTraceMatch(getenv("TRACE_MATCH", ""))
+	if err != nil {
+		log.Fatalf("TRACE_MATCH: %v", err)
+	}
+	lb.TraceMatch = traceMatch
+	lb.TraceRedact = getenvBool("TRACE_REDACT", lb.TraceRedact)
+	lb.traceLog = log.New(log.Writer(), "[trace] ", log.Flags())
+	if path := getenv("TRACE_LOG", ""); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("TRACE_LOG: %v", err)
+		}
+		lb.traceLog = log.New(f, "", 0)
+	}
+	http10, err := parseHTTP10Mode(getenv("HTTP10_MODE", lb.HTTP10Mode))
+	if err != nil {
+		log.Fatalf("HTTP10_MODE: %v", err)
+	}
+	lb.HTTP10Mode = http10
+	lb.HTTP10Host = getenv("HTTP10_HOST", "")
+	lb.ShutdownHeader = getenv("SHUTDOWN_HEADER", lb.ShutdownHeader)
+	if lb.ShutdownHeader == "none" {
+		lb.ShutdownHeader = ""
+	}
+	lb.DrainOnConnClose = getenvBool("DRAIN_ON_CONNECTION_CLOSE", false)
+	lb.ShutdownHold = getenvDuration("SHUTDOWN_HOLD", lb.ShutdownHold)
+	lb.ResponseSizeMetrics = getenvBool("RESPONSE_SIZE_METRICS", false)
+	lb.PreserveHost = getenvBool("PRESERVE_HOST", lb.PreserveHost)
+	lb.ForwardTrailers = getenvBool("FORWARD_TRAILERS", lb.ForwardTrailers)
+	lb.ForwardedPort = getenvBool("FORWARDED_PORT", false)
+	fwd, err := parseForwardedPolicy(getenv("FORWARDED_HEADERS", lb.ForwardedPolicy))
+	if err != nil {
+		log.Fatalf("FORWARDED_HEADERS: %v", err)
+	}
+	lb.ForwardedPolicy = fwd
+	lb.RewriteLocation = getenvBool("REWRITE_LOCATION", false)
+	if v := getenv("LOCATION_MAP", ""); v != "" {
+		m, err := parseLocationMap(v)
+		if err != nil {
+			log.Fatalf("LOCATION_MAP: %v", err)
+		}
+		lb.LocationMap, lb.RewriteLocation = m, true
+	}
+	if getenvBool("FORWARDED_SERVER", false) {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("FORWARDED_SERVER: %v", err)
+		}
+		lb.ForwardedServer = getenv("FORWARDED_SERVER_NAME", host)
+	}
+	errorHeaders, err := parseErrorHeaders(getenv("ERROR_HEADERS", ""))
+	if err != nil {
+		log.Fatalf("ERROR_HEADERS: %v", err)
+	}
+	lb.ErrorHeaders = errorHeaders
+	errorFormat, err := parseErrorFormat(getenv("ERROR_FORMAT", lb.ErrorFormat))
+	if err != nil {
+		log.Fatalf("ERROR_FORMAT: %v", err)
+	}
+	lb.ErrorFormat = errorFormat
+	errorPages, err := loadErrorPages(getenv("ERROR_PAGES", ""))
+	if err != nil {
+		log.Fatalf("ERROR_PAGES: %v", err)
+	}
+	lb.ErrorPages = errorPages
+	switch v := getenv("METRICS_CODE_LABELS", "detailed"); v {
+	case "detailed":
+	case "grouped":
+		lb.GroupStatusCodes = true
+	default:
+		log.Fatalf("unknown METRICS_CODE_LABELS %q (want detailed or grouped)", v)
+	}
+	lb.DeadLetterURL = getenv("DEAD_LETTER_URL", "")
+	lb.DeadLetterMaxBody = int(getenvInt64("DEAD_LETTER_MAX_BODY", 64<<10))
+
+	deny, err := parsePathRules(getenv("DENY_PATHS", ""))
+	if err != nil {
+		log.Fatalf("DENY_PATHS: %v", err)
+	}
+	lb.DenyPaths = deny
+	lb.MinHealthyFraction = getenvFraction("MIN_HEALTHY_FRACTION", 0)
+	shed, err := parsePathRules(getenv("DEGRADED_SHED_PATHS", ""))
+	if err != nil {
+		log.Fatalf("DEGRADED_SHED_PATHS: %v", err)
+	}
+	lb.DegradedShedPaths = shed
+	for _, m := range splitList(getenv("ALLOWED_METHODS", "")) {
+		lb.AllowedMethods = append(lb.AllowedMethods, strings.ToUpper(m))
+	}
+	if origins := splitList(getenv("CORS_ORIGINS", "")); len(origins) > 0 {
+		lb.CORS = &CORSPolicy{
+			Origins:     origins,
+			Methods:     splitList(getenv("CORS_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE")),
+			Headers:     splitList(getenv("CORS_HEADERS", "Content-Type,Authorization")),
+			Credentials: getenvBool("CORS_CREDENTIALS", false),
+			MaxAge:      getenvDuration("CORS_MAX_AGE", 10*time.Minute),
+		}
+		if err := checkCORS(lb.CORS.Origins, lb.CORS.Credentials); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	trusted, err := parseTrustedProxies(getenv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	lb.TrustedProxies = trusted
+	sources, err := parseIPSources(getenv("CLIENT_IP_SOURCES", "remote"))
+	if err != nil {
+		log.Fatalf("CLIENT_IP_SOURCES: %v", err)
+	}
+	lb.IPSources = sources
+
+	switch hc := getenv("HEALTH_CHECK_TYPE", HealthCheckHTTP); hc {
+	case HealthCheckHTTP, HealthCheckGRPC:
+		lb.HealthCheckType = hc
+	default:
+		log.Fatalf("unknown HEALTH_CHECK_TYPE %q", hc)
+	}
+	lb.HealthPath = getenv("HEALTH_PATH", lb.HealthPath)
+	lb.GRPCService = getenv("HEALTH_GRPC_SERVICE", "")
+	lb.HealthWeighting = getenvBool("HEALTH_WEIGHTING", false)
+	lb.WeightDecay = getenvFraction("WEIGHT_DECAY", 0)
+	lb.WeightDecayFloor = getenvFraction("WEIGHT_DECAY_FLOOR", lb.WeightDecayFloor)
+	lb.WeightRecovery = getenvFraction("WEIGHT_RECOVERY", lb.WeightRecovery)
+	lb.HealthRiseThreshold = int(getenvInt64("HEALTH_RISE_THRESHOLD", int64(lb.HealthRiseThreshold)))
+	lb.HealthLogInterval = getenvDuration("HEALTH_LOG_INTERVAL", lb.HealthLogInterval)
+	lb.HealthLatencyTarget = getenvDuration("HEALTH_LATENCY_TARGET", lb.HealthLatencyTarget)
+	lb.LoadHeader = getenv("LOAD_HEADER", "")
+	if lb.LoadHeader != "" && !lb.usesWeights() {
+		log.Printf("[LB] warning: LOAD_HEADER only reduces weight, which LB_STRATEGY=%s ignores; use %s", lb.Strategy, StrategyWeightedRoundRobin)
+	}
+
+	if n := int(getenvInt64("WARMUP_CONNS", 0)); n > 0 {
+		lb.SetWarmupConns(n)
+		for _, b := range lb.Backends {
+			go lb.warm(b)
+		}
+	}
+
 	lb.StartHealthChecks()
+	lb.DeepHealthPath = getenv("DEEP_HEALTH_PATH", "")
+	if lb.DeepHealthPath != "" {
+		lb.DeepHealthInterval = getenvDuration("DEEP_HEALTH_INTERVAL", lb.DeepHealthInterval)
+		lb.DeepHealthTimeout = getenvDuration("DEEP_HEALTH_TIMEOUT", lb.DeepHealthTimeout)
+		lb.DeepHealthWeight = getenvFraction("DEEP_HEALTH_WEIGHT", lb.DeepHealthWeight)
+		if lb.DeepHealthInterval <= 0 {
+			log.Fatalf("DEEP_HEALTH_INTERVAL must be positive, got %s", lb.DeepHealthInterval)
+		}
+		if lb.DeepHealthTimeout <= 0 {
+			log.Fatalf("DEEP_HEALTH_TIMEOUT must be positive, got %s", lb.DeepHealthTimeout)
+		}
+		if !lb.usesWeights() {
+			log.Printf("[LB] warning: DEEP_HEALTH_PATH only reduces weight, which LB_STRATEGY=%s ignores; use %s", lb.Strategy, StrategyWeightedRoundRobin)
+		}
+		lb.StartDeepHealthChecks()
+	}
+	lb.KeepaliveInterval = getenvDuration("POOL_KEEPALIVE_INTERVAL", 0)
+	lb.StartKeepalive()
+	lb.FairnessWindow = getenvDuration("FAIRNESS_WINDOW", lb.FairnessWindow)
+	lb.StartFairness()
 
 	addr := ":" + getenv("PORT", "8080")
 	log.Printf("Load Balancer listening on %s", addr)
-	log.Printf("Backends: %v", targets)
+	log.Printf("Backends (strategy=%s):", lb.Strategy)
+	for _, b := range lb.Backends {
+		log.Printf("  %s weight=%d zone=%q tier=%q keepalive=%t", b.URL, b.Weight, b.Zone, b.Tier, !b.transport.DisableKeepAlives)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/", logMiddleware(lb))
+	mux.HandleFunc("/readyz", readyzHandler)
+	// With ADMIN_PORT, /metrics and the admin surface (admin API + pprof)
+	// get their own listener, so they can be firewalled and rate-limited
+	// apart from client traffic and scrapes never queue behind clients.
+	// pprof is only served there: the client listener's WRITE_TIMEOUT is
+	// shorter than a default 30s CPU profile.
+	admin := lb.adminMux()
+	var adminSrv *http.Server
+	if port := getenv("ADMIN_PORT", ""); port != "" {
+		admin.Handle("/metrics", promhttp.Handler())
+		adminSrv = &http.Server{Addr: ":" + port, Handler: admin, ReadTimeout: 5 * time.Second}
+		go func() {
+			log.Printf("Admin and metrics listening on :%s", port)
+			if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("admin listener: %v", err)
+			}
+		}()
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/admin/", admin)
+		log.Printf("pprof disabled: set ADMIN_PORT to serve /debug/pprof")
+	}
+	idHeader := http.CanonicalHeaderKey(getenv("CORRELATION_HEADER", DefaultCorrelationHeader))
+	lb.RequestIDHeader = idHeader
+	mux.Handle("/", correlationID(idHeader, logMiddleware(idHeader, cors(lb.CORS, lb))))
+
+	authPaths, err := parsePathRules(getenv("BASIC_AUTH_PATHS", ""))
+	if err != nil {
+		log.Fatalf("BASIC_AUTH_PATHS: %v", err)
+	}
+	authUser, authPass := getenv("BASIC_AUTH_USER", ""), getenv("BASIC_AUTH_PASSWORD", "")
+	if len(authPaths) > 0 && (authUser == "" || authPass == "") {
+		log.Fatalf("BASIC_AUTH_PATHS set but BASIC_AUTH_USER/BASIC_AUTH_PASSWORD missing")
+	}
+
+	// The server cuts the client off at WRITE_TIMEOUT, so a backend allowed
+	// to take longer would only ever answer into a closed connection.
+	writeTimeout := getenvDuration("WRITE_TIMEOUT", 15*time.Second)
+	for _, b := range lb.backends() {
+		if writeTimeout > 0 && b.reqTimeout >= writeTimeout {
+			log.Fatalf("BACKENDS_JSON: %s req_timeout %s must be shorter than WRITE_TIMEOUT %s", b.Name, b.reqTimeout, writeTimeout)
+		}
+	}
 
 	srv := &http.Server{
 		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler:      lb.denyPaths(basicAuth(authPaths, authUser, authPass, mux)),
+		ReadTimeout:  getenvDuration("READ_TIMEOUT", 5*time.Second),
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  getenvDuration("IDLE_TIMEOUT", 60*time.Second),
+	}
+	if !getenvBool("CLIENT_KEEPALIVE", true) {
+		log.Printf("Client keep-alive disabled")
+		srv.SetKeepAlivesEnabled(false)
+	}
+
+	done := make(chan struct{})
+	go drainOnSignal(srv, adminSrv,
+		getenvDuration("PRESTOP_DELAY", 5*time.Second),
+		getenvDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		done)
+
+	ln, err := listen(addr, int(getenvInt64("LISTEN_BACKLOG", 0)), int(getenvInt64("LISTEN_RCVBUF", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// TLS termination: TLS_CERT_FILE/TLS_KEY_FILE are reloaded on SIGHUP
+	// and, with TLS_RELOAD_INTERVAL, when the files change on disk.
+	certFile, keyFile := getenv("TLS_CERT_FILE", ""), getenv("TLS_KEY_FILE", "")
+	useTLS := certFile != "" || keyFile != ""
+	if lb.ConnHighWater > 0 {
+		ln = &shedListener{Listener: ln, lb: lb, plain: !useTLS}
+	}
+	if useTLS {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("TLS: %v", err)
+		}
+		go certs.watch(getenvDuration("TLS_RELOAD_INTERVAL", 0))
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
 	}
-	log.Fatal(srv.ListenAndServe())
+	<-done
+	log.Printf("Load Balancer stopped")
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Traffic mirroring ================= */
+
+var lbMirrorTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_mirror_requests_total", Help: "Mirrored request copies by result (ok, error, dropped)"},
+	[]string{"result"},
+)
+
+func init() { prometheus.MustRegister(lbMirrorTotal) }
+
+// AddMirrorPool registers a pool (e.g. staging) that receives
+// fire-and-forget copies of MirrorPercent of proxied requests. Its
+// backends are health-checked and round-robined like any other pool.
+func (lb *LoadBalancer) AddMirrorPool(targets []BackendConfig) {
+	backends := lb.newBackends(targets)
+	lb.MirrorPool = &Pool{Name: "mirror", Backends: backends}
+	lb.Backends = append(lb.Backends, backends...)
+	lb.mirrorSlots = make(chan struct{}, lb.MirrorMaxInFlight)
+}
+
+// shouldMirror samples r for mirroring. Streams and upgrades are never
+// mirrored since they cannot be replayed.
+func (lb *LoadBalancer) shouldMirror(r *http.Request) bool {
+	if lb.MirrorPool == nil || lb.MirrorPercent <= 0 || isEventStream(r) || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return rand.Float64()*100 < lb.MirrorPercent
+}
+
+// hopHeaders apply to a single connection and are not forwarded; see
+// RFC 9110 section 7.6.1.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// mirrorHeader is r's header as sent to a mirror: hop-by-hop headers
+// (including any named in Connection) and client credentials are removed,
+// since the copy goes over its own connection to a less trusted pool.
+func mirrorHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	for _, name := range redactedHeaders {
+		h.Del(name)
+	}
+	return h
+}
+
+// mirror sends a copy of r (with the already-buffered body) to the next
+// alive mirror backend in the background. It never blocks the client:
+// when MirrorMaxInFlight copies are outstanding the copy is dropped, and
+// the mirror response is discarded whatever it is.
+func (lb *LoadBalancer) mirror(r *http.Request, body []byte) {
+	select {
+	case lb.mirrorSlots <- struct{}{}:
+	default:
+		lbMirrorTotal.WithLabelValues("dropped").Inc()
+		return
+	}
+	lb.MirrorPool.mu.Lock()
+	b, _, err := lb.MirrorPool.nextRoundRobin(nil)
+	lb.MirrorPool.mu.Unlock()
+	if err != nil {
+		<-lb.mirrorSlots
+		lbMirrorTotal.WithLabelValues("dropped").Inc()
+		return
+	}
+	u := *b.target
+	u.Path, u.RawPath = b.target.Path+r.URL.Path, ""
+	u.RawQuery = r.URL.RawQuery
+	header := mirrorHeader(r.Header)
+	header.Set("X-LB-Mirror", "1")
+	host := r.Host
+
+	go func() {
+		defer func() { <-lb.mirrorSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), lb.MirrorTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			lbMirrorTotal.WithLabelValues("error").Inc()
+			return
+		}
+		req.Header, req.Host = header, host
+		if !lb.preservesHost(b) {
+			req.Host = b.target.Host
+		}
+		resp, err := b.transport.RoundTrip(req)
+		if err != nil {
+			lbMirrorTotal.WithLabelValues("error").Inc()
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		lbMirrorTotal.WithLabelValues("ok").Inc()
+	}()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/* ================= Response buffering ================= */
+
+const (
+	// ResponseStream copies responses to the client as they arrive: least
+	// memory and latency, but a backend failing mid-body cannot be retried.
+	ResponseStream = "stream"
+	// ResponseBuffer reads the whole response (up to ResponseBufferBytes)
+	// before sending anything, so a body that breaks off is retried like
+	// any other failure. Larger responses fall back to streaming.
+	ResponseBuffer = "buffer"
+)
+
+func parseResponseMode(v string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(v)); m {
+	case ResponseStream, ResponseBuffer:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want %s or %s)", v, ResponseStream, ResponseBuffer)
+}
+
+// bufferResponse replaces resp.Body with an in-memory copy when it fits in
+// limit bytes. A read error is returned so the attempt fails before any
+// byte reaches the client. Over the limit, the bytes already read are
+// replayed ahead of the rest of the stream.
+func bufferResponse(resp *http.Response, limit int64) error {
+	if resp.Body == nil || resp.Body == http.NoBody ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("reading response body: %w", err)
+	}
+	if int64(len(buf)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	// trailers need a chunked response, so only fix the length without them
+	if len(resp.Trailer) == 0 {
+		resp.ContentLength = int64(len(buf))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	}
+	return nil
+}
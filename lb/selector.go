@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+/* ================= Selectors ================= */
+
+// Selector picks the backend for one attempt of r from p, reading any
+// settings it needs from lb. tried holds the backends already attempted
+// for r and must be skipped; it is keyed by backend rather than index
+// because p.Backends can be rebuilt while r is in flight.
+// It returns the backend and its index, errAllTried when alive backends
+// remain but all were tried, or errNoAlive. Pick runs with p.mu held, so
+// it may keep per-pool state in p but must not call back into the pool.
+type Selector interface {
+	Pick(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error)
+}
+
+// SelectorFunc adapts a plain function to Selector.
+type SelectorFunc func(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error)
+
+func (f SelectorFunc) Pick(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+	return f(lb, p, r, tried)
+}
+
+var (
+	selectorsMu sync.RWMutex
+	selectors   = map[string]Selector{}
+)
+
+// RegisterSelector makes s available as LB_STRATEGY=name. Custom selectors
+// are registered from an init function in their own file; registering a
+// name twice panics.
+func RegisterSelector(name string, s Selector) {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	if _, dup := selectors[name]; dup {
+		panic("selector already registered: " + name)
+	}
+	selectors[name] = s
+}
+
+func lookupSelector(name string) (Selector, bool) {
+	selectorsMu.RLock()
+	defer selectorsMu.RUnlock()
+	s, ok := selectors[name]
+	return s, ok
+}
+
+func selectorNames() []string {
+	selectorsMu.RLock()
+	defer selectorsMu.RUnlock()
+	names := make([]string, 0, len(selectors))
+	for n := range selectors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterSelector(StrategyRoundRobin, SelectorFunc(func(_ *LoadBalancer, p *Pool, _ *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		return p.nextRoundRobin(tried)
+	}))
+	RegisterSelector(StrategyWeightedRoundRobin, SelectorFunc(func(_ *LoadBalancer, p *Pool, _ *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		return p.nextWeighted(tried)
+	}))
+	RegisterSelector(StrategyPathHash, SelectorFunc(func(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		return p.nextHashed(r.URL.Path, lb.HashFallbackDepth, tried)
+	}))
+	// client_hash gives sticky sessions: a client keeps its backend, and
+	// its fallback, for as long as they stay alive.
+	RegisterSelector(StrategyClientHash, SelectorFunc(func(lb *LoadBalancer, p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, error) {
+		return p.nextHashed(lb.clientIP(r), lb.HashFallbackDepth, tried)
+	}))
+}
+
+// nextHealthiest picks the untried alive backend least likely to fail
+// next: fewest consecutive failures, then highest health score, then
+// fewest in-flight requests. Used for retries with RetryPreferHealthy,
+// where the next backend in rotation may be struggling too. Caller holds
+// p.mu.
+func (p *Pool) nextHealthiest(tried map[*Backend]bool) (*Backend, int, error) {
+	best, alive := -1, false
+	var bestFails int
+	var bestScore float64
+	var bestActive int64
+	for i, b := range p.Backends {
+		if !b.IsAlive() {
+			continue
+		}
+		alive = true
+		if tried[b] {
+			continue
+		}
+		b.mu.RLock()
+		fails, score := b.ConsecFailures, b.score
+		b.mu.RUnlock()
+		active := b.active.Load()
+		if best < 0 || fails < bestFails ||
+			(fails == bestFails && (score > bestScore || (score == bestScore && active < bestActive))) {
+			best, bestFails, bestScore, bestActive = i, fails, score, active
+		}
+	}
+	if best >= 0 {
+		return p.Backends[best], best, nil
+	}
+	if alive {
+		return nil, -1, errAllTried
+	}
+	return nil, -1, errNoAlive
+}
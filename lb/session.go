@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* ================= Learned session affinity ================= */
+
+// sessionAffinity pins application sessions to the backend that issued
+// them. The session id is learned from responses, either the value of
+// the Cookie set via Set-Cookie or of the Header (e.g.
+// X-Session-Backend-Hint), and looked up on requests from the same cookie
+// or header. Entries expire TTL after last use; at most Max are kept.
+type sessionAffinity struct {
+	Cookie string
+	Header string
+	TTL    time.Duration
+	Max    int
+
+	mu       sync.Mutex
+	sessions map[string]sessionEntry
+}
+
+type sessionEntry struct {
+	backend *Backend
+	expires time.Time
+}
+
+func newSessionAffinity(cookie, header string, ttl time.Duration, max int) *sessionAffinity {
+	return &sessionAffinity{Cookie: cookie, Header: header, TTL: ttl, Max: max, sessions: map[string]sessionEntry{}}
+}
+
+// requestID returns the session id carried by r, if any.
+func (s *sessionAffinity) requestID(r *http.Request) string {
+	if s.Cookie != "" {
+		if c, err := r.Cookie(s.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if s.Header != "" {
+		return r.Header.Get(s.Header)
+	}
+	return ""
+}
+
+// lookup returns the backend pinned for id, refreshing its TTL.
+func (s *sessionAffinity) lookup(id string) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(e.expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	e.expires = now.Add(s.TTL)
+	s.sessions[id] = e
+	return e.backend
+}
+
+func (s *sessionAffinity) put(id string, b *Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, ok := s.sessions[id]; !ok && len(s.sessions) >= s.Max {
+		for k, e := range s.sessions {
+			if now.After(e.expires) {
+				delete(s.sessions, k)
+			}
+		}
+		// Still full of live sessions: drop an arbitrary one.
+		for k := range s.sessions {
+			if len(s.sessions) < s.Max {
+				break
+			}
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = sessionEntry{backend: b, expires: now.Add(s.TTL)}
+}
+
+func (s *sessionAffinity) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// learn records the session a backend issued in resp. A cookie being
+// deleted (Max-Age < 0 or empty value) ends the session.
+func (s *sessionAffinity) learn(b *Backend, resp *http.Response) {
+	if s.Cookie != "" {
+		for _, c := range resp.Cookies() {
+			if c.Name != s.Cookie {
+				continue
+			}
+			if c.Value == "" || c.MaxAge < 0 {
+				if id := s.requestID(resp.Request); id != "" {
+					s.forget(id)
+				}
+				continue
+			}
+			s.put(c.Value, b)
+		}
+	}
+	if s.Header != "" {
+		if id := resp.Header.Get(s.Header); id != "" {
+			s.put(id, b)
+		}
+	}
+}
+
+func (s *sessionAffinity) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// sessionBackend returns the alive, untried backend in p that r's session
+// is pinned to, with its index in p, or ok=false to fall back to the
+// strategy. A backend cooling off after a Retry-After is skipped like any
+// other choice, so the session moves on rather than hitting it.
+func (lb *LoadBalancer) sessionBackend(p *Pool, r *http.Request, tried map[*Backend]bool) (*Backend, int, bool) {
+	if lb.sessions == nil {
+		return nil, -1, false
+	}
+	id := lb.sessions.requestID(r)
+	if id == "" {
+		return nil, -1, false
+	}
+	b := lb.sessions.lookup(id)
+	if b == nil || !b.IsAlive() || b.coolingOff(time.Now()) {
+		return nil, -1, false
+	}
+	for i, x := range p.members() {
+		if x == b && !tried[b] {
+			return b, i, true
+		}
+	}
+	return nil, -1, false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/* ================= Backend-reported shutdown ================= */
+
+// noteShutdown takes b out of selection as soon as one of its responses
+// says it is shutting down: ShutdownHeader set to "true"/"1", or, with
+// DrainOnConnClose, "Connection: close". This beats the next failed probe
+// by up to HealthInterval. The header is not passed on to the client.
+// "Connection: close" only counts when the LB did not ask for it, either
+// through b's disable_keepalive or a request that itself said close.
+func (lb *LoadBalancer) noteShutdown(b *Backend, resp *http.Response) {
+	signalled := false
+	if lb.ShutdownHeader != "" {
+		v := strings.ToLower(strings.TrimSpace(resp.Header.Get(lb.ShutdownHeader)))
+		signalled = v == "true" || v == "1"
+		resp.Header.Del(lb.ShutdownHeader)
+	}
+	if lb.DrainOnConnClose && resp.Close && !b.transport.DisableKeepAlives && (resp.Request == nil || !resp.Request.Close) {
+		signalled = true
+	}
+	if signalled && b.shutdownAt.CompareAndSwap(0, time.Now().UnixNano()) {
+		log.Printf("[drain] %s reports shutting down; no new requests for at least %s", b.Name, lb.ShutdownHold)
+	}
+}
+
+// clearShutdown lets b back into selection once a probe passes at least
+// ShutdownHold after it reported shutting down, i.e. it has restarted or
+// changed its mind.
+func (lb *LoadBalancer) clearShutdown(b *Backend) {
+	at := b.shutdownAt.Load()
+	if at != 0 && time.Since(time.Unix(0, at)) >= lb.ShutdownHold && b.shutdownAt.CompareAndSwap(at, 0) {
+		log.Printf("[drain] %s passing probes again after shutdown signal", b.Name)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ================= Serve-stale ================= */
+
+// staleEntry is a copy of a successful GET response kept for use during a
+// full outage, as allowed by its Cache-Control stale-if-error directive.
+type staleEntry struct {
+	header http.Header
+	body   []byte
+	stored time.Time
+	usable time.Duration // max-age + stale-if-error
+}
+
+// staleCache is a small bounded FIFO of stale-if-error responses.
+type staleCache struct {
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+	order   []string
+	max     int
+	maxBody int
+}
+
+func newStaleCache(maxEntries, maxBody int) *staleCache {
+	return &staleCache{entries: map[string]*staleEntry{}, max: maxEntries, maxBody: maxBody}
+}
+
+func staleKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// cacheDirective returns the seconds value of a Cache-Control directive.
+func cacheDirective(cc, name string) (time.Duration, bool) {
+	for _, d := range strings.Split(cc, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(k, name) {
+			n, err := strconv.Atoi(strings.Trim(v, `"`))
+			if err != nil || n < 0 {
+				return 0, false
+			}
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+func (c *staleCache) put(key string, e *staleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = e
+	for len(c.order) > c.max {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *staleCache) get(key string) (*staleEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.stored) > e.usable {
+		return nil, false
+	}
+	return e, true
+}
+
+// shareable reports whether a response may be replayed to other clients:
+// the cache is shared, so anything personalised (credentialed requests,
+// cookies, private or no-store, or a Vary the key does not capture) is not.
+func shareable(req *http.Request, resp *http.Response, cc string) bool {
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return false
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 || len(resp.Header.Values("Vary")) > 0 {
+		return false
+	}
+	cc = strings.ToLower(cc)
+	return !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store")
+}
+
+// record arranges for a cacheable GET 200 to be copied into the cache as
+// its body streams to the client. Bodies over maxBody are not kept.
+func (c *staleCache) record(resp *http.Response) {
+	req := resp.Request
+	if req == nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	cc := resp.Header.Get("Cache-Control")
+	sie, ok := cacheDirective(cc, "stale-if-error")
+	if !ok || !shareable(req, resp, cc) {
+		return
+	}
+	maxAge, _ := cacheDirective(cc, "max-age")
+	e := &staleEntry{header: resp.Header.Clone(), stored: time.Now(), usable: maxAge + sie}
+	resp.Body = &staleRecorder{ReadCloser: resp.Body, cache: c, key: staleKey(req), entry: e}
+}
+
+type staleRecorder struct {
+	io.ReadCloser
+	cache    *staleCache
+	key      string
+	entry    *staleEntry
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (s *staleRecorder) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.overflow {
+		if s.buf.Len()+n > s.cache.maxBody {
+			s.overflow = true
+			s.buf = bytes.Buffer{}
+		} else {
+			s.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !s.overflow {
+		s.entry.body = bytes.Clone(s.buf.Bytes())
+		s.cache.put(s.key, s.entry)
+		s.overflow = true // store once
+	}
+	return n, err
+}
+
+// serveStale writes a cached copy of r's response if one is still usable.
+func (lb *LoadBalancer) serveStale(w http.ResponseWriter, r *http.Request) bool {
+	if lb.stale == nil || r.Method != http.MethodGet {
+		return false
+	}
+	e, ok := lb.stale.get(staleKey(r))
+	if !ok {
+		return false
+	}
+	for k, vs := range e.header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("Age", fmt.Sprintf("%d", int(time.Since(e.stored).Seconds())))
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("X-LB-Stale", "true")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(e.body)
+	lbStaleServedTotal.Inc()
+	return true
+}
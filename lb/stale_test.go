@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+// staleResponse answers every GET with a stale-if-error response, adding
+// whatever extra headers the test asks for.
+func staleResponse(extra http.Header) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		for k, vs := range extra {
+			w.Header()[k] = vs
+		}
+		io.WriteString(w, "for "+r.Header.Get("Authorization"))
+	}
+}
+
+// primeThenFail sends req through a stale-caching LB, takes the backend
+// down, then repeats the URL without credentials and returns that status.
+func primeThenFail(t *testing.T, extra http.Header, prime func(*http.Request)) int {
+	t.Helper()
+	h := newHandlerHarness(t, staleResponse(extra))
+	h.lb.stale = newStaleCache(10, 1<<20)
+	h.lb.MaxRetries = 0
+
+	req, _ := http.NewRequest("GET", h.front.URL+"/me", nil)
+	prime(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	h.backends[0].Close()
+	h.lb.Backends[0].SetAlive(false)
+	resp, err = http.Get(h.front.URL + "/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStaleServedDuringOutage(t *testing.T) {
+	if code := primeThenFail(t, nil, func(*http.Request) {}); code != http.StatusOK {
+		t.Fatalf("status %d, want the stale 200", code)
+	}
+}
+
+func TestStaleNeverServesPersonalisedResponses(t *testing.T) {
+	cases := map[string]struct {
+		extra http.Header
+		prime func(*http.Request)
+	}{
+		"set-cookie":    {http.Header{"Set-Cookie": {"sid=abc"}}, func(*http.Request) {}},
+		"private":       {http.Header{"Cache-Control": {"private, max-age=60, stale-if-error=600"}}, func(*http.Request) {}},
+		"vary":          {http.Header{"Vary": {"Accept-Language"}}, func(*http.Request) {}},
+		"authorization": {nil, func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice") }},
+		"cookie":        {nil, func(r *http.Request) { r.Header.Set("Cookie", "sid=alice") }},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if code := primeThenFail(t, c.extra, c.prime); code == http.StatusOK {
+				t.Fatal("personalised response served stale to another client")
+			}
+		})
+	}
+}
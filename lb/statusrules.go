@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* ================= Status retry rules ================= */
+
+// statusRule is what happens when a backend answers with a given status
+// while retries remain: retry (in pool, or the current pool when nil) or
+// pass the response through.
+type statusRule struct {
+	retry bool
+	pool  *Pool
+}
+
+// parseStatusRules reads STATUS_RETRY_RULES, e.g.
+// "429=pool:overflow,503=retry,501=none". Pool names are resolved against
+// the pools registered so far by lookup.
+func parseStatusRules(v string, lookup func(string) *Pool) (map[int]statusRule, error) {
+	rules := map[int]statusRule{}
+	for _, item := range splitList(v) {
+		k, action, ok := strings.Cut(item, "=")
+		code, err := strconv.Atoi(strings.TrimSpace(k))
+		if !ok || err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("bad rule %q (want <4xx|5xx status>=retry|none|pool:<name>)", item)
+		}
+		switch action = strings.TrimSpace(action); {
+		case action == "retry":
+			rules[code] = statusRule{retry: true}
+		case action == "none":
+			rules[code] = statusRule{}
+		case strings.HasPrefix(action, "pool:"):
+			name := strings.TrimPrefix(action, "pool:")
+			p := lookup(name)
+			if p == nil {
+				return nil, fmt.Errorf("rule %q: unknown pool %q", item, name)
+			}
+			rules[code] = statusRule{retry: true, pool: p}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown action %q", item, action)
+		}
+	}
+	return rules, nil
+}
+
+// statusAction is the rule for code; without one, 5xx retries in the
+// current pool and anything else passes through.
+func (lb *LoadBalancer) statusAction(code int) statusRule {
+	if rule, ok := lb.StatusRules[code]; ok {
+		return rule
+	}
+	return statusRule{retry: code >= 500}
+}
+
+// poolNamed finds a registered pool (including upload) by name. The mirror
+// pool is never returned: it only ever sees shadow copies, so client
+// retries must not be sent there.
+func (lb *LoadBalancer) poolNamed(name string) *Pool {
+	for _, p := range lb.allPools() {
+		if p.Name == name && p != lb.MirrorPool {
+			return p
+		}
+	}
+	return nil
+}
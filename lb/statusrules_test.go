@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStatusRuleRetriesInOtherPool(t *testing.T) {
+	h := newHandlerHarness(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	spare := newTestBackend(nil)
+	defer spare.Close()
+	h.lb.AddPool("overflow", []BackendConfig{{URL: spare.URL}})
+	rules, err := parseStatusRules("429=pool:overflow", h.lb.poolNamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.lb.StatusRules = rules
+
+	if code := h.get(); code != http.StatusOK {
+		t.Errorf("status %d, want the overflow pool's 200", code)
+	}
+	if got := spare.hits.Load(); got != 1 {
+		t.Errorf("overflow pool got %d requests, want 1", got)
+	}
+}
+
+func TestStatusRuleRejectsUnknownPool(t *testing.T) {
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://127.0.0.1:1"}})
+	if _, err := parseStatusRules("429=pool:nope", lb.poolNamed); err == nil {
+		t.Error("rule naming an unknown pool accepted")
+	}
+}
+
+func TestStatusRuleRejectsMirrorPool(t *testing.T) {
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://127.0.0.1:1"}})
+	lb.AddMirrorPool([]BackendConfig{{URL: "http://127.0.0.1:2"}})
+	if _, err := parseStatusRules("503=pool:mirror", lb.poolNamed); err == nil {
+		t.Error("rule sending retries to the mirror pool accepted")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Per-tenant rate limits ================= */
+
+var lbTenantLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_tenant_rate_limited_total", Help: "Requests rejected with 429 by per-tenant rate limits"},
+	[]string{"tenant"},
+)
+
+var lbTierLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_tier_rate_limited_total", Help: "Requests rejected with 429 by per-tier rate limits (TIER_LIMITS)"},
+	[]string{"tier"},
+)
+
+func init() { prometheus.MustRegister(lbTenantLimitedTotal, lbTierLimitedTotal) }
+
+// rateLimit is a token-bucket rate: RPS tokens per second, up to Burst.
+type rateLimit struct {
+	RPS   float64
+	Burst float64
+}
+
+// parseRateLimit parses "rps:burst"; burst defaults to rps rounded up.
+func parseRateLimit(v string) (rateLimit, error) {
+	rps, burst, hasBurst := strings.Cut(strings.TrimSpace(v), ":")
+	l := rateLimit{}
+	var err error
+	if l.RPS, err = strconv.ParseFloat(rps, 64); err != nil || l.RPS <= 0 {
+		return l, fmt.Errorf("invalid rate %q: want rps[:burst]", v)
+	}
+	l.Burst = math.Ceil(l.RPS)
+	if hasBurst {
+		if l.Burst, err = strconv.ParseFloat(burst, 64); err != nil || l.Burst < 1 {
+			return l, fmt.Errorf("invalid burst in %q", v)
+		}
+	}
+	return l, nil
+}
+
+// parseTenantLimits parses TENANT_LIMITS: comma-separated
+// "tenant=rps[:burst]" entries.
+func parseTenantLimits(v string) (map[string]rateLimit, error) {
+	m := map[string]rateLimit{}
+	for _, pair := range splitList(v) {
+		tenant, rate, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(tenant) == "" {
+			return nil, fmt.Errorf("invalid entry %q: want tenant=rps[:burst]", pair)
+		}
+		l, err := parseRateLimit(rate)
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(tenant)] = l
+	}
+	return m, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// defaultBucket is the key of the bucket all tenants without their own
+// limit share; it cannot collide with a header value.
+const defaultBucket = "\x00default"
+
+// tenantLimiter enforces a token bucket per tenant, identified by Header
+// (or, as lb.tierLimits, per JWT tier, with no Header).
+// Tenants not in Limits share one Default bucket, or are unlimited when it
+// is zero: the header is client-supplied, so a fresh ID must not bring a
+// fresh bucket, and the bucket map stays bounded by Limits. Buckets idle
+// for IdleTTL are dropped; a dropped bucket comes back full.
+type tenantLimiter struct {
+	Header  string
+	Limits  map[string]rateLimit
+	Default rateLimit
+	IdleTTL time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newTenantLimiter(header string, limits map[string]rateLimit, def rateLimit, idle time.Duration) *tenantLimiter {
+	return &tenantLimiter{Header: header, Limits: limits, Default: def, IdleTTL: idle,
+		buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// allow takes a token for tenant, reporting false when none is left.
+func (t *tenantLimiter) allow(tenant string, now time.Time) bool {
+	l, ok := t.Limits[tenant]
+	if !ok {
+		l, tenant = t.Default, defaultBucket
+	}
+	if l.RPS <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) > t.IdleTTL {
+		for k, b := range t.buckets {
+			if now.Sub(b.last) > t.IdleTTL {
+				delete(t.buckets, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	b, ok := t.buckets[tenant]
+	if !ok {
+		b = &bucket{tokens: l.Burst, last: now}
+		t.buckets[tenant] = b
+	}
+	b.tokens = min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.RPS)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// tenantLimited answers 429 when r's tenant, or its JWT tier, is over its
+// rate. Requests without the tenant header are not tenant-limited, and
+// tiers without a TIER_LIMITS entry are not tier-limited.
+func (lb *LoadBalancer) tenantLimited(w http.ResponseWriter, r *http.Request, tier string) bool {
+	now := time.Now()
+	if lb.tenants != nil {
+		if tenant := r.Header.Get(lb.tenants.Header); tenant != "" && !lb.tenants.allow(tenant, now) {
+			// Only configured tenants get their own label, to bound cardinality.
+			label := "other"
+			if _, ok := lb.tenants.Limits[tenant]; ok {
+				label = tenant
+			}
+			lbTenantLimitedTotal.WithLabelValues(label).Inc()
+			w.Header().Set("Retry-After", "1")
+			lb.writeError(w, r, http.StatusTooManyRequests, reasonRateLimited, "tenant rate limit exceeded")
+			return true
+		}
+	}
+	if lb.tierLimits != nil && tier != "" && !lb.tierLimits.allow(tier, now) {
+		// a tier is only ever limited when it is configured, so the label is bounded
+		lbTierLimitedTotal.WithLabelValues(tier).Inc()
+		w.Header().Set("Retry-After", "1")
+		lb.writeError(w, r, http.StatusTooManyRequests, reasonRateLimited, "tier rate limit exceeded")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* ================= TLS termination ================= */
+
+// certReloader serves the certificate from certFile/keyFile and swaps in
+// a new one on SIGHUP or, with an interval, when either file changes.
+// Handshakes in progress and established connections are unaffected.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	modTime           time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the key pair; on error the previous certificate stays.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", cr.certFile, err)
+	}
+	cr.cert.Store(&cert)
+	cr.modTime = cr.latestModTime()
+	return nil
+}
+
+func (cr *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
+
+// watch reloads on SIGHUP and, when interval > 0, whenever the files'
+// modification time moves forward.
+func (cr *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			if !cr.latestModTime().After(cr.modTime) {
+				continue
+			}
+		}
+		if err := cr.reload(); err != nil {
+			log.Printf("[tls] reload failed, keeping current certificate: %v", err)
+			continue
+		}
+		log.Printf("[tls] reloaded certificate from %s", cr.certFile)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+/* ================= Request trace log ================= */
+
+// traceRule selects requests for the trace log: a header (optionally
+// with a value) or a client IP or CIDR.
+type traceRule struct {
+	header, value string
+	net           *net.IPNet
+}
+
+// parseTraceMatch parses TRACE_MATCH, comma-separated rules of the form
+// "header:X-Debug", "header:X-Debug=1" or "ip:10.1.2.3" / "ip:10.1.0.0/16".
+func parseTraceMatch(v string) ([]traceRule, error) {
+	var rules []traceRule
+	for _, item := range splitList(v) {
+		kind, arg, _ := strings.Cut(item, ":")
+		switch kind {
+		case "header":
+			name, value, _ := strings.Cut(arg, "=")
+			if name == "" {
+				return nil, fmt.Errorf("rule %q: missing header name", item)
+			}
+			rules = append(rules, traceRule{header: name, value: value})
+		case "ip":
+			nets, err := parseTrustedProxies(arg)
+			if err != nil || len(nets) != 1 {
+				return nil, fmt.Errorf("rule %q: want ip:<ip or cidr>", item)
+			}
+			rules = append(rules, traceRule{net: nets[0]})
+		default:
+			return nil, fmt.Errorf("rule %q: want header:<name>[=<value>] or ip:<ip or cidr>", item)
+		}
+	}
+	return rules, nil
+}
+
+func (lb *LoadBalancer) traceMatches(r *http.Request) bool {
+	for _, rule := range lb.TraceMatch {
+		if rule.net != nil {
+			if ip := net.ParseIP(lb.clientIP(r)); ip != nil && rule.net.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		// a repeated header matches if any of its values does
+		if vs := r.Header.Values(rule.header); len(vs) > 0 && (rule.value == "" || slices.Contains(vs, rule.value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedHeaders never reach the trace log or dead-letter sink verbatim.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Lb-Admin-Token"}
+
+// redactHeader returns a copy of h with redactedHeaders masked.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := h[name]; ok {
+			h[name] = []string{"[redacted]"}
+		}
+	}
+	return h
+}
+
+type traceAttempt struct {
+	Backend string `json:"backend"`
+	Pool    string `json:"pool"`
+	Start   string `json:"start"` // since the request arrived
+	Took    string `json:"took"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// requestTrace is one request's lifecycle, written to the trace log as a
+// single JSON line when it finishes. A nil *requestTrace (the request did
+// not match TraceMatch) ignores every call.
+type requestTrace struct {
+	Time     time.Time      `json:"time"`
+	ID       string         `json:"id,omitempty"`
+	Client   string         `json:"client"`
+	Method   string         `json:"method"`
+	Host     string         `json:"host"`
+	URI      string         `json:"uri"`
+	Proto    string         `json:"proto"`
+	Header   http.Header    `json:"header"`
+	Attempts []traceAttempt `json:"attempts"`
+	Status   int            `json:"status"`
+	Took     string         `json:"took"`
+}
+
+// startTrace begins a trace for r if it matches TraceMatch. Headers are
+// recorded in full, masked by redactHeader unless TraceRedact is off.
+func (lb *LoadBalancer) startTrace(r *http.Request, start time.Time) *requestTrace {
+	if len(lb.TraceMatch) == 0 || !lb.traceMatches(r) {
+		return nil
+	}
+	header := r.Header.Clone()
+	if lb.TraceRedact {
+		header = redactHeader(r.Header)
+	}
+	return &requestTrace{
+		Time: start, ID: r.Header.Get(lb.RequestIDHeader), Client: lb.clientIP(r),
+		Method: r.Method, Host: r.Host, URI: r.RequestURI, Proto: r.Proto, Header: header,
+	}
+}
+
+func (t *requestTrace) attempt(b *Backend, pool string, began time.Time, status int, err error) {
+	if t == nil {
+		return
+	}
+	a := traceAttempt{
+		Backend: b.Name, Pool: pool, Status: status,
+		Start: began.Sub(t.Time).String(), Took: time.Since(began).String(),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	t.Attempts = append(t.Attempts, a)
+}
+
+func (t *requestTrace) finish(l *log.Logger, status int) {
+	if t == nil {
+		return
+	}
+	if l == nil {
+		l = log.Default()
+	}
+	t.Status, t.Took = status, time.Since(t.Time).String()
+	line, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	l.Print(string(line))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceMatch(t *testing.T) {
+	rules, err := parseTraceMatch("header:X-Debug, header:X-Trace=1, ip:10.1.2.3, ip:10.2.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("got %d rules, want 4", len(rules))
+	}
+	if rules[1].header != "X-Trace" || rules[1].value != "1" {
+		t.Errorf("rule 1 = %+v, want header X-Trace value 1", rules[1])
+	}
+	if rules[2].net.String() != "10.1.2.3/32" || rules[3].net.String() != "10.2.0.0/16" {
+		t.Errorf("ip rules = %v, %v", rules[2].net, rules[3].net)
+	}
+	for _, v := range []string{"header:", "header:=1", "ip:", "ip:nope", "ip:10.0.0.1,10.0.0.2", "path:/x", "X-Debug"} {
+		if _, err := parseTraceMatch(v); err == nil {
+			t.Errorf("TRACE_MATCH=%q accepted", v)
+		}
+	}
+}
+
+func TestTraceMatches(t *testing.T) {
+	rules, err := parseTraceMatch("header:X-Debug=1,ip:10.2.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &LoadBalancer{TraceMatch: rules, IPSources: []string{"remote"}}
+	for _, tc := range []struct {
+		name  string
+		peer  string
+		debug []string
+		want  bool
+	}{
+		{"no match", "192.0.2.1", nil, false},
+		{"header value", "192.0.2.1", []string{"1"}, true},
+		{"other header value", "192.0.2.1", []string{"0"}, false},
+		{"value in a repeated header", "192.0.2.1", []string{"0", "1"}, true},
+		{"client in CIDR", "10.2.3.4", nil, true},
+		{"client outside CIDR", "10.3.0.1", nil, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer + ":4000"
+		for _, v := range tc.debug {
+			r.Header.Add("X-Debug", v)
+		}
+		if got := lb.traceMatches(r); got != tc.want {
+			t.Errorf("%s: traceMatches = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+// traceLine runs one traced request with a single failed attempt and
+// returns the JSON line written for it.
+func traceLine(t *testing.T, redact bool) map[string]any {
+	t.Helper()
+	rules, err := parseTraceMatch("header:X-Debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer([]BackendConfig{{URL: "http://backend:8080"}})
+	lb.TraceMatch, lb.TraceRedact = rules, redact
+	r := httptest.NewRequest(http.MethodGet, "/cart?id=7", nil)
+	r.Header.Set("X-Debug", "1")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(lb.RequestIDHeader, "req-1")
+
+	start := time.Now()
+	tr := lb.startTrace(r, start)
+	tr.attempt(lb.Backends[0], "default", start, http.StatusBadGateway, errors.New("refused"))
+	var buf bytes.Buffer
+	tr.finish(log.New(&buf, "", 0), http.StatusBadGateway)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("trace line %q: %v", buf.String(), err)
+	}
+	return line
+}
+
+func TestTraceLine(t *testing.T) {
+	line := traceLine(t, true)
+	if line["id"] != "req-1" || line["method"] != "GET" || line["uri"] != "/cart?id=7" || line["status"] != float64(502) {
+		t.Errorf("trace line %v", line)
+	}
+	attempts, _ := line["attempts"].([]any)
+	if len(attempts) != 1 {
+		t.Fatalf("attempts = %v, want one", line["attempts"])
+	}
+	if a := attempts[0].(map[string]any); a["backend"] != "backend:8080" || a["status"] != float64(502) || a["error"] != "refused" {
+		t.Errorf("attempt = %v", a)
+	}
+	header := line["header"].(map[string]any)
+	if got := header["Authorization"].([]any)[0]; got != "[redacted]" {
+		t.Errorf("Authorization = %v, want it redacted", got)
+	}
+}
+
+func TestTraceRedactOff(t *testing.T) {
+	header := traceLine(t, false)["header"].(map[string]any)
+	if got := header["Authorization"].([]any)[0]; got != "Bearer secret" {
+		t.Errorf("Authorization = %v, want it verbatim with TRACE_REDACT off", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// trailerBackend streams a body and sends one declared and one undeclared
+// trailer, the way gRPC-web and chunked backends report status.
+func trailerBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "part1 ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "part2")
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "all good")
+	}))
+}
+
+func getThroughLB(t *testing.T, lb *LoadBalancer) *http.Response {
+	t.Helper()
+	front := httptest.NewServer(lb)
+	t.Cleanup(front.Close)
+	resp, err := http.Get(front.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "part1 part2" {
+		t.Fatalf("body = %q, want %q", body, "part1 part2")
+	}
+	return resp
+}
+
+func TestTrailersForwarded(t *testing.T) {
+	backend := trailerBackend()
+	defer backend.Close()
+	lb := NewLoadBalancer([]BackendConfig{{URL: backend.URL}})
+
+	resp := getThroughLB(t, lb)
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want %q", got, "0")
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "all good" {
+		t.Errorf("Grpc-Message trailer = %q, want %q", got, "all good")
+	}
+}
+
+func TestTrailersDropped(t *testing.T) {
+	backend := trailerBackend()
+	defer backend.Close()
+	lb := NewLoadBalancer([]BackendConfig{{URL: backend.URL}})
+	lb.ForwardTrailers = false
+
+	resp := getThroughLB(t, lb)
+	if len(resp.Trailer) != 0 {
+		t.Errorf("trailers = %v, want none", resp.Trailer)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/* ================= Config validation ================= */
+
+// configCheck validates one part of the environment config; detail is
+// printed next to a passing check.
+type configCheck struct {
+	name string
+	run  func() (detail string, err error)
+}
+
+// validateConfig runs the same parsing main does, without starting
+// anything, and writes one line per check to w. It returns the process
+// exit code: 0 when every check passed, 1 otherwise. Used by -validate.
+func validateConfig(w io.Writer) int {
+	failed := 0
+	for _, c := range append(configChecks(), typedEnvChecks()...) {
+		detail, err := c.run()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %-20s %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "ok   %-20s %s\n", c.name, detail)
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Fprintln(w, "config valid")
+	return 0
+}
+
+// typedEnv maps every variable main reads through getenvInt64, getenvBool,
+// getenvDuration or getenvFraction to that helper's error-returning form.
+// TestTypedEnvCoversMain fails when main reads one that is missing here.
+var typedEnv = func() map[string]func(string) (string, error) {
+	m := map[string]func(string) (string, error){}
+	add := func(parse func(string) (string, error), keys ...string) {
+		for _, k := range keys {
+			m[k] = parse
+		}
+	}
+	add(func(k string) (string, error) { n, err := envInt64(k, 0); return fmt.Sprint(n), err },
+		"ADAPTIVE_HIGH_WATER", "ADAPTIVE_LOW_WATER", "CONN_HIGH_WATER", "DEAD_LETTER_MAX_BODY",
+		"HASH_FALLBACK_DEPTH", "HEALTH_RISE_THRESHOLD", "LISTEN_BACKLOG", "LISTEN_RCVBUF",
+		"MAX_BODY_BYTES", "MAX_RESPONSE_HEADER_BYTES", "MAX_RETRIES_CAP", "MIRROR_MAX_IN_FLIGHT",
+		"RESPONSE_BUFFER_BYTES", "RETRY_BODY_BYTES", "SESSION_MAX_ENTRIES", "STALE_MAX_BODY",
+		"STALE_MAX_ENTRIES", "UPLOAD_THRESHOLD_BYTES", "WARMUP_CONNS")
+	add(func(k string) (string, error) { b, err := envBool(k, false); return fmt.Sprint(b), err },
+		"ATTEMPT_TRACE", "CLIENT_KEEPALIVE", "CORS_CREDENTIALS", "DRAIN_ON_CONNECTION_CLOSE",
+		"EXPOSE_BACKEND_HEADER", "FORWARDED_PORT", "FORWARDED_SERVER", "FORWARD_PROXY",
+		"FORWARD_TRAILERS", "HEALTH_WEIGHTING", "MASK_UPSTREAM_ERRORS", "POOL_FAIL_FAST",
+		"PRESERVE_HOST", "RESPONSE_SIZE_METRICS", "RETRY_ALL_BACKENDS", "RETRY_PREFER_HEALTHY",
+		"REWRITE_LOCATION", "SERVE_STALE", "TLS_ERROR_TRIPS_BREAKER",
+		"TRACE_REDACT")
+	add(func(k string) (string, error) { d, err := envDuration(k, 0); return d.String(), err },
+		"BACKEND_MAX_CONN_AGE", "BACKEND_RETRY_AFTER_MAX", "CORS_MAX_AGE", "DEEP_HEALTH_INTERVAL",
+		"DEEP_HEALTH_TIMEOUT", "DIAL_FALLBACK_DELAY", "DIAL_TIMEOUT", "FAIRNESS_WINDOW", "HEALTH_LATENCY_TARGET",
+		"HEALTH_LOG_INTERVAL", "IDLE_TIMEOUT", "MIRROR_TIMEOUT", "POOL_KEEPALIVE_INTERVAL",
+		"POOL_PROBE_INTERVAL", "PRESTOP_DELAY", "READ_TIMEOUT", "RETRY_AFTER", "SESSION_TTL",
+		"SHUTDOWN_HOLD", "SHUTDOWN_TIMEOUT", "SLOW_REQUEST_THRESHOLD", "SLO_THRESHOLD",
+		"TENANT_IDLE_TTL", "TLS_RELOAD_INTERVAL", "TOTAL_TIMEOUT", "WRITE_TIMEOUT")
+	add(func(k string) (string, error) { f, err := envFraction(k, 0); return fmt.Sprint(f), err },
+		"DEEP_HEALTH_WEIGHT", "MIN_HEALTHY_FRACTION", "WEIGHT_DECAY", "WEIGHT_DECAY_FLOOR", "WEIGHT_RECOVERY")
+	return m
+}()
+
+// typedEnvChecks checks each typedEnv variable that is set; unset ones
+// take main's default and cannot be wrong.
+func typedEnvChecks() []configCheck {
+	var keys []string
+	for k := range typedEnv {
+		if os.Getenv(k) != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	checks := make([]configCheck, 0, len(keys))
+	for _, k := range keys {
+		parse := typedEnv[k]
+		checks = append(checks, configCheck{k, func() (string, error) { return parse(k) }})
+	}
+	return checks
+}
+
+// backendsCheck parses a backend list with parse and validates it.
+func backendsCheck(name string, parse func(string) ([]BackendConfig, error)) configCheck {
+	return configCheck{name, func() (string, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return "unset", nil
+		}
+		cfgs, err := parse(v)
+		if err == nil {
+			err = validateBackends(cfgs)
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d backend(s)", len(cfgs)), nil
+	}}
+}
+
+// rulesCheck compiles a path rule list such as DENY_PATHS.
+func rulesCheck(name string) configCheck {
+	return configCheck{name, func() (string, error) {
+		rules, err := parsePathRules(os.Getenv(name))
+		return fmt.Sprintf("%d rule(s)", len(rules)), err
+	}}
+}
+
+// configuredPool stands in for poolNamed before any pool exists: it knows
+// which pools main would register from the environment. Like poolNamed it
+// never returns the mirror pool.
+func configuredPool(name string) *Pool {
+	env := map[string]string{"blue": "BLUE_BACKENDS", "green": "GREEN_BACKENDS", "upload": "UPLOAD_BACKENDS",
+		"overflow": "OVERFLOW_BACKENDS"}
+	if v, ok := env[name]; ok && os.Getenv(v) != "" || name == "default" && os.Getenv("BLUE_BACKENDS") == "" {
+		return &Pool{Name: name}
+	}
+	return nil
+}
+
+// oneOf checks that name, when set, is one of the allowed values.
+func oneOf(name string, allowed ...string) configCheck {
+	return configCheck{name, func() (string, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return "default", nil
+		}
+		for _, a := range allowed {
+			if v == a {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of %s", v, strings.Join(allowed, ", "))
+	}}
+}
+
+func configChecks() []configCheck {
+	return []configCheck{
+		backendsCheck("BACKENDS", parseBackendsCSV),
+		backendsCheck("BACKENDS_JSON", parseBackendsJSON),
+		backendsCheck("BLUE_BACKENDS", parseBackendsCSV),
+		backendsCheck("GREEN_BACKENDS", parseBackendsCSV),
+		backendsCheck("UPLOAD_BACKENDS", parseBackendsCSV),
+		backendsCheck("MIRROR_BACKENDS", parseBackendsCSV),
+		backendsCheck("OVERFLOW_BACKENDS", parseBackendsCSV),
+		oneOf("LB_STRATEGY", selectorNames()...),
+		oneOf("ADAPTIVE_LOW_STRATEGY", selectorNames()...),
+		oneOf("ADAPTIVE_HIGH_STRATEGY", selectorNames()...),
+		oneOf("ACTIVE_POOL", "blue", "green"),
+		oneOf("EXPECT_CONTINUE", ExpectForward, ExpectLocal),
+		oneOf("RESPONSE_MODE", ResponseStream, ResponseBuffer),
+		oneOf("DIAL_MODE", DialDualStack, DialIPv4, DialIPv6),
+		oneOf("HEALTH_CHECK_TYPE", HealthCheckHTTP, HealthCheckGRPC),
+		oneOf("METRICS_CODE_LABELS", "detailed", "grouped"),
+		oneOf("ERROR_FORMAT", ErrorFormatText, ErrorFormatJSON),
+		oneOf("HTTP10_MODE", HTTP10Normalize, HTTP10Pass, HTTP10Reject),
+		oneOf("FORWARDED_HEADERS", ForwardedTrusted, ForwardedStrip, ForwardedKeep),
+		{"ERROR_PAGES", func() (string, error) {
+			pages, err := loadErrorPages(os.Getenv("ERROR_PAGES"))
+			return fmt.Sprintf("%d page(s)", len(pages)), err
+		}},
+		{"ERROR_HEADERS", func() (string, error) {
+			h, err := parseErrorHeaders(os.Getenv("ERROR_HEADERS"))
+			return fmt.Sprintf("%d header(s)", len(h)), err
+		}},
+		rulesCheck("DENY_PATHS"),
+		rulesCheck("BASIC_AUTH_PATHS"),
+		rulesCheck("DEGRADED_SHED_PATHS"),
+		{"LOCATION_MAP", func() (string, error) {
+			m, err := parseLocationMap(os.Getenv("LOCATION_MAP"))
+			return fmt.Sprintf("%d mapping(s)", len(m)), err
+		}},
+		{"TENANT_LIMITS", func() (string, error) {
+			m, err := parseTenantLimits(os.Getenv("TENANT_LIMITS"))
+			if err == nil && os.Getenv("TENANT_DEFAULT_LIMIT") != "" {
+				_, err = parseRateLimit(os.Getenv("TENANT_DEFAULT_LIMIT"))
+			}
+			return fmt.Sprintf("%d tenant(s)", len(m)), err
+		}},
+		{"TIER_LIMITS", func() (string, error) {
+			m, err := parseTenantLimits(os.Getenv("TIER_LIMITS"))
+			if err == nil && len(m) > 0 && os.Getenv("JWT_TIER_CLAIM") == "" {
+				err = fmt.Errorf("TIER_LIMITS needs JWT_TIER_CLAIM")
+			}
+			return fmt.Sprintf("%d tier(s)", len(m)), err
+		}},
+		{"STATUS_RETRY_RULES", func() (string, error) {
+			rules, err := parseStatusRules(os.Getenv("STATUS_RETRY_RULES"), configuredPool)
+			return fmt.Sprintf("%d rule(s)", len(rules)), err
+		}},
+		{"TRACE_MATCH", func() (string, error) {
+			rules, err := parseTraceMatch(os.Getenv("TRACE_MATCH"))
+			return fmt.Sprintf("%d rule(s)", len(rules)), err
+		}},
+		{"CONNECT_ALLOW", func() (string, error) {
+			allow, err := parseConnectAllow(os.Getenv("CONNECT_ALLOW"))
+			return fmt.Sprintf("%d destination(s)", len(allow)), err
+		}},
+		{"CORS_ORIGINS", func() (string, error) {
+			origins := splitList(os.Getenv("CORS_ORIGINS"))
+			creds, _ := envBool("CORS_CREDENTIALS", false)
+			return fmt.Sprintf("%d origin(s)", len(origins)), checkCORS(origins, creds)
+		}},
+		{"TRUSTED_PROXIES", func() (string, error) {
+			nets, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+			return fmt.Sprintf("%d network(s)", len(nets)), err
+		}},
+		{"CLIENT_IP_SOURCES", func() (string, error) {
+			sources, err := parseIPSources(getenv("CLIENT_IP_SOURCES", "remote"))
+			return strings.Join(sources, ","), err
+		}},
+		{"TLS_CERT_FILE", func() (string, error) {
+			cert, key := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+			if cert == "" && key == "" {
+				return "unset", nil
+			}
+			if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+				return "", err
+			}
+			return "key pair loads", nil
+		}},
+	}
+}
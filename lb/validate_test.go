@@ -0,0 +1,71 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestTypedEnvCoversMain finds every typed getenv call in the package and
+// checks -validate knows its variable.
+func TestTypedEnvCoversMain(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			fn, ok := call.Fun.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			switch fn.Name {
+			case "getenvInt64", "getenvBool", "getenvDuration", "getenvFraction":
+			default:
+				return true
+			}
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok {
+				t.Errorf("%s: %s with a non-literal key cannot be validated", fset.Position(call.Pos()), fn.Name)
+				return true
+			}
+			key, _ := strconv.Unquote(lit.Value)
+			if _, ok := typedEnv[key]; !ok {
+				t.Errorf("%s: %s(%q) is missing from typedEnv", fset.Position(call.Pos()), fn.Name, key)
+			}
+			return true
+		})
+	}
+}
+
+func TestValidateRejectsBadTypedValue(t *testing.T) {
+	if code := validateConfig(io.Discard); code != 0 {
+		t.Fatalf("default config: exit code %d, want 0", code)
+	}
+	for k, v := range map[string]string{
+		"WRITE_TIMEOUT": "abc", "MAX_BODY_BYTES": "1MB", "SERVE_STALE": "maybe", "WEIGHT_DECAY": "1.5",
+	} {
+		t.Setenv(k, v)
+		if code := validateConfig(io.Discard); code != 1 {
+			t.Errorf("%s=%q: exit code %d, want 1", k, v, code)
+		}
+		t.Setenv(k, "")
+	}
+}
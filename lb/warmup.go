@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* ================= Connection warmup ================= */
+
+var lbKeepalivePings = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "lb_keepalive_pings_total", Help: "Idle-pool keepalive requests per backend by result"},
+	[]string{"backend", "result"},
+)
+
+func init() { prometheus.MustRegister(lbKeepalivePings) }
+
+// SetWarmupConns enables warmup and makes sure each backend's transport can
+// keep that many idle connections (the stdlib default is 2 per host).
+func (lb *LoadBalancer) SetWarmupConns(n int) {
+	lb.WarmupConns = n
+	for _, b := range lb.backends() {
+		if b.transport.MaxIdleConnsPerHost < n {
+			b.transport.MaxIdleConnsPerHost = n
+		}
+	}
+}
+
+// warm opens WarmupConns connections to b in parallel through its proxy
+// transport and returns them to the idle pool, so the first real requests
+// skip dial and TLS handshake.
+func (lb *LoadBalancer) warm(b *Backend) {
+	if lb.WarmupConns <= 0 {
+		return
+	}
+	ok := lb.touchConns(b, http.MethodGet, lb.WarmupConns)
+	log.Printf("[warmup] %s: %d/%d connections ready", b.Name, ok, lb.WarmupConns)
+}
+
+// touchConns sends n parallel requests for HealthPath through b's proxy
+// transport, reusing idle connections where there are any and dialing
+// the rest, and reports how many succeeded.
+func (lb *LoadBalancer) touchConns(b *Backend, method string, n int) int {
+	client := &http.Client{Transport: b.transport, Timeout: lb.HealthTimeout}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(method, b.target.String()+lb.HealthPath, nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			mu.Lock()
+			ok++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return ok
+}
+
+// StartKeepalive pings every alive backend with HEAD requests each
+// KeepaliveInterval, so idle pool connections are neither reaped by
+// NATs and firewalls nor by the backend's own idle timeout. Unlike health
+// checks the results do not affect routing; they only keep the pool
+// warm. It sends as many pings as WarmupConns (at least one), and skips
+// a backend whose previous set is still running.
+func (lb *LoadBalancer) StartKeepalive() {
+	if lb.KeepaliveInterval <= 0 {
+		return
+	}
+	n := max(lb.WarmupConns, 1)
+	t := time.NewTicker(lb.KeepaliveInterval)
+	go func() {
+		for range t.C {
+			for _, b := range lb.backends() {
+				if !b.IsAlive() || b.draining.Load() || !b.pinging.CompareAndSwap(false, true) {
+					continue
+				}
+				go func(b *Backend) {
+					defer b.pinging.Store(false)
+					ok := lb.touchConns(b, http.MethodHead, n)
+					lbKeepalivePings.WithLabelValues(b.Name, "ok").Add(float64(ok))
+					lbKeepalivePings.WithLabelValues(b.Name, "error").Add(float64(n - ok))
+				}(b)
+			}
+		}
+	}()
+}